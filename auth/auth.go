@@ -0,0 +1,247 @@
+// Package auth implements player accounts, and signed session tokens
+// that prove the identity of a player to the game servers.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Account constants
+const (
+	// Shortest name of an account
+	NAME_LEN_MIN = 3
+	// Longest name of an account, the same as in the games
+	NAME_LEN_MAX = 16
+	// Shortest password
+	PASSWORD_LEN_MIN = 8
+	// Time before a token must be renewed by logging in again
+	TOKEN_TIME = 30 * 24 * time.Hour
+	// Prefix of the names given to anonymous players who ask for a reserved name
+	GUEST_PREFIX = "guest-"
+)
+
+var (
+	ErrBadName     = fmt.Errorf("names must have %v to %v letters, digits or '-', and not start with %v", NAME_LEN_MIN, NAME_LEN_MAX, GUEST_PREFIX)
+	ErrBadPassword = fmt.Errorf("passwords must have at least %v characters", PASSWORD_LEN_MIN)
+	ErrNameTaken   = errors.New("name is taken")
+	ErrLogin       = errors.New("wrong name or password")
+)
+
+// reservedNames cannot be registered or used by anonymous players.
+var reservedNames = []string{"admin", "administrator", "moderator", "server", "system"}
+
+// Auth issues and verifies tokens for registered accounts.
+// Players without an account may still play anonymously,
+// but not with the name of an account.
+type Auth struct {
+	key   []byte
+	users *users
+}
+
+// New makes an Auth with accounts stored in a JSON file.
+// Tokens are signed with key, or with a random key if it is blank,
+// in which case they are only valid until the server restarts.
+func New(path, key string) (*Auth, error) {
+	u, err := loadUsers(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &Auth{key: []byte(key), users: u}
+	if key == "" {
+		log.Printf("*auth: no key, tokens will expire on restart\n")
+		a.key = make([]byte, sha256.Size)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// nameKey is the form of a name used to compare names, ignoring case.
+func nameKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// validName checks if a name can be registered.
+func validName(name string) bool {
+	if len(name) < NAME_LEN_MIN || len(name) > NAME_LEN_MAX {
+		return false
+	}
+	if strings.HasPrefix(nameKey(name), GUEST_PREFIX) {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= '0' && r <= '9',
+			r >= 'A' && r <= 'Z',
+			r >= 'a' && r <= 'z',
+			r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Reserved checks if a name belongs to an account, is reserved,
+// or looks like a guest name, ignoring case.
+// If a is nil, no name is reserved.
+func (a *Auth) Reserved(name string) bool {
+	if a == nil {
+		return false
+	}
+	key := nameKey(name)
+	if strings.HasPrefix(key, GUEST_PREFIX) {
+		return true
+	}
+	for _, r := range reservedNames {
+		if key == r {
+			return true
+		}
+	}
+	return a.users.exists(name)
+}
+
+// Register creates an account and returns a token for it.
+func (a *Auth) Register(name, password string) (string, error) {
+	if !validName(name) {
+		return "", ErrBadName
+	}
+	if len(password) < PASSWORD_LEN_MIN {
+		return "", ErrBadPassword
+	}
+	for _, r := range reservedNames {
+		if nameKey(name) == r {
+			return "", ErrNameTaken
+		}
+	}
+	if err := a.users.add(name, password); err != nil {
+		return "", err
+	}
+	return a.Token(name), nil
+}
+
+// Login checks the password of an account and returns a token for it.
+func (a *Auth) Login(name, password string) (string, error) {
+	name, ok := a.users.check(name, password)
+	if !ok {
+		return "", ErrLogin
+	}
+	return a.Token(name), nil
+}
+
+// sign returns the signature of a token payload.
+func (a *Auth) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token returns a token for an account, valid for TOKEN_TIME.
+// Tokens are the name and expiry time, followed by a signature:
+// "name.expiry.signature".
+func (a *Auth) Token(name string) string {
+	expiry := strconv.FormatInt(time.Now().Add(TOKEN_TIME).Unix(), 10)
+	payload := name + "." + expiry
+	return payload + "." + a.sign(payload)
+}
+
+// Verify returns the name of the account of a token,
+// and false if the token is invalid or expired.
+func (a *Auth) Verify(token string) (string, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i == -1 {
+		return "", false
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(a.sign(payload))) {
+		return "", false
+	}
+
+	name, expiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	t, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > t {
+		return "", false
+	}
+	return name, true
+}
+
+// Identify returns the name that a player should be shown with,
+// and its identity for statistics, which is blank for anonymous players.
+// Players with a valid token get the name of their account.
+// Anonymous players who ask for a reserved name get a guest name instead.
+func (a *Auth) Identify(token, name string) (shown, id string) {
+	if a == nil {
+		return name, ""
+	}
+	if token != "" {
+		if account, ok := a.Verify(token); ok {
+			return account, account
+		}
+	}
+	if a.Reserved(name) {
+		n, _ := rand.Int(rand.Reader, big.NewInt(10000))
+		return fmt.Sprintf("%v%04d", GUEST_PREFIX, n), ""
+	}
+	return name, ""
+}
+
+// loginResponse is the JSON response to HandleLogin and HandleRegister.
+type loginResponse struct {
+	Name  string `json:"name,omitempty"`
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// respond writes a token, or an error with the given status.
+func respond(w http.ResponseWriter, name, token string, err error, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	resp := loginResponse{Name: name, Token: token}
+	if err != nil {
+		resp = loginResponse{Error: err.Error()}
+		w.WriteHeader(status)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// HandleRegister creates an account from the "name" and "password" form values
+// of a POST request, and responds with a token as JSON.
+func (a *Auth) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PostFormValue("name")
+	token, err := a.Register(name, r.PostFormValue("password"))
+	if err == nil {
+		log.Printf("*[%v] registered %v\n", r.RemoteAddr, name)
+	}
+	respond(w, name, token, err, http.StatusBadRequest)
+}
+
+// HandleLogin checks the "name" and "password" form values of a POST request,
+// and responds with a token as JSON.
+func (a *Auth) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	token, err := a.Login(r.PostFormValue("name"), r.PostFormValue("password"))
+	name, _ := a.Verify(token)
+	respond(w, name, token, err, http.StatusUnauthorized)
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Password hashing constants
+const (
+	// PBKDF2 iterations
+	HASH_ITER = 100000
+	// Length of salts and hashes
+	HASH_LEN = 32
+)
+
+// user is a registered account.
+type user struct {
+	Name string `json:"name"` // as registered, with its case
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+}
+
+// users are the registered accounts, keyed by lowercase name,
+// saved to a JSON file on every change.
+type users struct {
+	path  string
+	users map[string]*user
+	lock  sync.Mutex
+}
+
+// loadUsers loads accounts from a JSON file,
+// which is created on the first registration if it does not exist.
+func loadUsers(path string) (*users, error) {
+	u := &users{
+		path:  path,
+		users: make(map[string]*user),
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(b, &u.users); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// hashPassword derives a hash from a password with PBKDF2-HMAC-SHA256.
+// HASH_LEN is the size of a SHA-256 sum, so only one block is needed.
+func hashPassword(password string, salt []byte) []byte {
+	prf := hmac.New(sha256.New, []byte(password))
+	prf.Write(salt)
+	binary.Write(prf, binary.BigEndian, uint32(1))
+	u := prf.Sum(nil)
+
+	hash := append([]byte(nil), u...)
+	for i := 1; i < HASH_ITER; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range hash {
+			hash[j] ^= u[j]
+		}
+	}
+	return hash
+}
+
+// add registers an account, and saves the accounts.
+func (u *users) add(name, password string) error {
+	salt := make([]byte, HASH_LEN)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash := hashPassword(password, salt)
+
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	key := nameKey(name)
+	if u.users[key] != nil {
+		return ErrNameTaken
+	}
+	u.users[key] = &user{name, salt, hash}
+	if err := u.save(); err != nil {
+		delete(u.users, key)
+		return err
+	}
+	return nil
+}
+
+// check returns the registered name of an account if the password matches.
+func (u *users) check(name, password string) (string, bool) {
+	u.lock.Lock()
+	us := u.users[nameKey(name)]
+	u.lock.Unlock()
+
+	if us == nil {
+		return "", false
+	}
+	hash := hashPassword(password, us.Salt)
+	return us.Name, subtle.ConstantTimeCompare(hash, us.Hash) == 1
+}
+
+// exists checks if a name is registered, ignoring case.
+func (u *users) exists(name string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.users[nameKey(name)] != nil
+}
+
+// save writes the accounts to a temporary file, and replaces the file with it.
+// The caller must hold u.lock.
+func (u *users) save() error {
+	b, err := json.Marshal(u.users)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), filepath.Base(u.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), u.path)
+}
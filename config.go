@@ -0,0 +1,432 @@
+package main
+
+import (
+	"victorz.ca/gameserv/duel"
+	"victorz.ca/gameserv/origin"
+	"victorz.ca/gameserv/slime"
+
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the server. It is read from a JSON file,
+// and command-line flags override the values in the file.
+type Config struct {
+	// Address to listen on, or blank to use the PORT environment variable
+	Addr string `json:"addr"`
+	// Origins whose pages may connect to the games, besides the server's host.
+	// The first that matches an origin applies, and "*" matches every origin.
+	Origins []origin.Policy `json:"origins"`
+	// Key that must be presented to see the numbers of rejected connections,
+	// or blank for them to be hidden
+	OriginsKey string `json:"origins_key"`
+
+	// JSON file of player statistics, or blank to not record them
+	StatsFile string `json:"stats_file"`
+	// JSON file of accounts, or blank for every player to be anonymous
+	AuthFile string `json:"auth_file"`
+	// Key that signs login tokens, or blank for tokens to expire on restart
+	AuthKey string `json:"auth_key"`
+
+	Routes Routes      `json:"routes"`
+	Slime  SlimeConfig `json:"slime"`
+	Duel   DuelConfig  `json:"duel"`
+}
+
+// Routes are the paths that the games are served on.
+type Routes struct {
+	// Slime players, and the number of players at Slime + "/n"
+	Slime string `json:"slime"`
+	// Duel players, and the other duel handlers under Duel + "/"
+	Duel     string `json:"duel"`
+	Stats    string `json:"stats"`
+	Login    string `json:"login"`
+	Register string `json:"register"`
+	// Numbers of connections rejected by origin, given the origins key
+	Origins string `json:"origins"`
+}
+
+// SlimeConfig configures the slime server.
+type SlimeConfig struct {
+	PhysFPS    int `json:"phys_fps"`
+	NetFPS     int `json:"net_fps"`
+	SendBuffer int `json:"send_buffer"`
+}
+
+// DuelConfig configures every duel arena.
+type DuelConfig struct {
+	PhysFPS    int `json:"phys_fps"`
+	NetFPS     int `json:"net_fps"`
+	MaxPlayers int `json:"max_players"`
+	Population int `json:"population"` // target number of players and bots
+	SendBuffer int `json:"send_buffer"`
+	// Seconds that the slot of a disconnected player is kept for it to resume,
+	// or 0 to remove disconnected players immediately
+	ResumeGrace int `json:"resume_grace"`
+	// Let bots control disconnected players until they resume
+	ResumePilot bool `json:"resume_pilot"`
+	// Milestones of kills without dying, in increasing order.
+	// They are only set in the file.
+	Streaks []duel.Streak `json:"streaks"`
+
+	BotNames string `json:"bot_names"` // file of bot names, one per line
+	Skins    string `json:"skins"`     // file of skin names, one per line
+	Maps     string `json:"maps"`      // directory of JSON maps
+	Replays  string `json:"replays"`   // directory where replays are recorded
+	// Key that must be presented to change arenas over HTTP,
+	// or blank for arenas to not be changed over HTTP
+	AdminKey string `json:"admin_key"`
+
+	// Arenas that are always open, by name. They are only set in the file.
+	Arenas map[string]ArenaConfig `json:"arenas"`
+}
+
+// ArenaConfig configures a named duel arena, which players join by name.
+// Values that are not given are those of every arena.
+type ArenaConfig struct {
+	Population *int     `json:"population"`
+	Teams      int      `json:"teams"`      // or 0 for free-for-all
+	Collision  string   `json:"collision"`  // "random" or "mass"
+	Cover      *float64 `json:"cover"`      // with "mass" collision
+	RoundTime  int      `json:"round_time"` // seconds, or 0 to play without rounds
+	RoundWin   string   `json:"round_win"`  // "score" or "mass"
+	Royale     bool     `json:"royale"`
+	// Milestones of kills without dying, or null for those of every arena
+	Streaks []duel.Streak `json:"streaks"`
+}
+
+// Names of collision modes and round win modes in ArenaConfig
+var (
+	collisionModes = map[string]duel.CollisionMode{
+		"random": duel.CollideRandom,
+		"mass":   duel.CollideMass,
+	}
+	roundWinModes = map[string]duel.RoundWinMode{
+		"score": duel.WinByScore,
+		"mass":  duel.WinByMass,
+	}
+)
+
+// options returns the options of the arena, based on those of every arena.
+func (a ArenaConfig) options(opt duel.Options) (duel.Options, error) {
+	if a.Population != nil {
+		opt.Population = *a.Population
+	}
+	opt.Teams = a.Teams
+	if a.Collision != "" {
+		mode, ok := collisionModes[a.Collision]
+		if !ok {
+			return opt, fmt.Errorf("unknown collision %q", a.Collision)
+		}
+		opt.Collision = mode
+	}
+	if a.Cover != nil {
+		opt.Cover = *a.Cover
+	}
+	opt.RoundTime = time.Duration(a.RoundTime) * time.Second
+	if a.RoundWin != "" {
+		mode, ok := roundWinModes[a.RoundWin]
+		if !ok {
+			return opt, fmt.Errorf("unknown round win %q", a.RoundWin)
+		}
+		opt.RoundWin = mode
+	}
+	opt.Royale = a.Royale
+	if a.Streaks != nil {
+		opt.Streaks = a.Streaks
+	}
+	return opt, opt.Validate()
+}
+
+// defaultConfig returns the configuration used without a file or flags.
+// Files and keys default to the environment variables that used to set them.
+func defaultConfig() *Config {
+	slimeOpt := slime.DefaultOptions()
+	duelOpt := duel.DefaultOptions()
+	return &Config{
+		StatsFile: os.Getenv("STATS_FILE"),
+		AuthFile:  os.Getenv("AUTH_FILE"),
+		AuthKey:   os.Getenv("AUTH_KEY"),
+		Routes: Routes{
+			Slime:    "/s",
+			Duel:     "/d",
+			Stats:    "/stats",
+			Login:    "/login",
+			Register: "/register",
+			Origins:  "/origins",
+		},
+		Slime: SlimeConfig{
+			PhysFPS:    slimeOpt.PhysFPS,
+			NetFPS:     slimeOpt.NetFPS,
+			SendBuffer: slimeOpt.SendBuffer,
+		},
+		Duel: DuelConfig{
+			PhysFPS:     duelOpt.PhysFPS,
+			NetFPS:      duelOpt.NetFPS,
+			MaxPlayers:  duelOpt.MaxPlayers,
+			Population:  duelOpt.Population,
+			SendBuffer:  duelOpt.SendBuffer,
+			ResumeGrace: int(duelOpt.ResumeGrace / time.Second),
+			ResumePilot: duelOpt.ResumePilot,
+			Streaks:     append([]duel.Streak(nil), duelOpt.Streaks...), // not shared with the file
+			BotNames:    os.Getenv("DUEL_BOT_NAMES"),
+			Skins:       os.Getenv("DUEL_SKINS"),
+			Maps:        os.Getenv("DUEL_MAPS"),
+			Replays:     os.Getenv("DUEL_REPLAYS"),
+			AdminKey:    os.Getenv("DUEL_ADMIN_KEY"),
+		},
+	}
+}
+
+// flags defines a command-line flag for each value, defaulting to its current value.
+func (c *Config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address to listen on")
+	fs.Var((*originsFlag)(&c.Origins), "origins", "comma-separated origins whose pages may connect, each followed by =spectate if they may only spectate")
+	fs.StringVar(&c.OriginsKey, "origins-key", c.OriginsKey, "key to see the numbers of rejected connections by origin")
+	fs.StringVar(&c.StatsFile, "stats-file", c.StatsFile, "JSON file of player statistics")
+	fs.StringVar(&c.AuthFile, "auth-file", c.AuthFile, "JSON file of accounts")
+	fs.StringVar(&c.AuthKey, "auth-key", c.AuthKey, "key that signs login tokens")
+
+	fs.StringVar(&c.Routes.Slime, "route-slime", c.Routes.Slime, "path of slime players")
+	fs.StringVar(&c.Routes.Duel, "route-duel", c.Routes.Duel, "path of duel players")
+	fs.StringVar(&c.Routes.Stats, "route-stats", c.Routes.Stats, "path of player statistics")
+	fs.StringVar(&c.Routes.Login, "route-login", c.Routes.Login, "path of logins")
+	fs.StringVar(&c.Routes.Register, "route-register", c.Routes.Register, "path of registrations")
+	fs.StringVar(&c.Routes.Origins, "route-origins", c.Routes.Origins, "path of rejected origin counts")
+
+	fs.IntVar(&c.Slime.PhysFPS, "slime-phys-fps", c.Slime.PhysFPS, "slime physics frames per second")
+	fs.IntVar(&c.Slime.NetFPS, "slime-net-fps", c.Slime.NetFPS, "slime world states per second")
+	fs.IntVar(&c.Slime.SendBuffer, "slime-send-buffer", c.Slime.SendBuffer, "slime messages queued per player")
+
+	fs.IntVar(&c.Duel.PhysFPS, "duel-phys-fps", c.Duel.PhysFPS, "duel physics frames per second")
+	fs.IntVar(&c.Duel.NetFPS, "duel-net-fps", c.Duel.NetFPS, "duel world states per second")
+	fs.IntVar(&c.Duel.MaxPlayers, "duel-max-players", c.Duel.MaxPlayers, "duel player slots per arena")
+	fs.IntVar(&c.Duel.Population, "duel-population", c.Duel.Population, "duel players and bots per arena")
+	fs.IntVar(&c.Duel.SendBuffer, "duel-send-buffer", c.Duel.SendBuffer, "duel messages queued per client")
+	fs.IntVar(&c.Duel.ResumeGrace, "duel-resume-grace", c.Duel.ResumeGrace, "seconds that duel players may take to resume after disconnecting")
+	fs.BoolVar(&c.Duel.ResumePilot, "duel-resume-pilot", c.Duel.ResumePilot, "let bots control disconnected duel players")
+	fs.StringVar(&c.Duel.BotNames, "duel-bot-names", c.Duel.BotNames, "file of duel bot names")
+	fs.StringVar(&c.Duel.Skins, "duel-skins", c.Duel.Skins, "file of duel skin names")
+	fs.StringVar(&c.Duel.Maps, "duel-maps", c.Duel.Maps, "directory of duel maps")
+	fs.StringVar(&c.Duel.Replays, "duel-replays", c.Duel.Replays, "directory where duel replays are recorded")
+	fs.StringVar(&c.Duel.AdminKey, "duel-admin-key", c.Duel.AdminKey, "key to change duel arenas over HTTP")
+}
+
+// loadConfig reads the configuration file named by the -config flag or the
+// CONFIG_FILE environment variable, if any, applies the other flags,
+// and validates the result.
+func loadConfig(args []string) (*Config, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("gameserv", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "JSON configuration file")
+	c.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if *path != "" {
+		file := defaultConfig()
+		if err := file.read(*path); err != nil {
+			return nil, err
+		}
+
+		// Flags that were given override the file
+		ffs := flag.NewFlagSet("", flag.ContinueOnError)
+		file.flags(ffs)
+		var err error
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name != "config" && err == nil {
+				err = ffs.Set(f.Name, f.Value.String())
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		c = file
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// read reads a JSON configuration file over the current values.
+// Unknown keys are rejected, so that typos are not ignored.
+func (c *Config) read(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	return nil
+}
+
+// validate checks that the configuration is usable.
+func (c *Config) validate() error {
+	if c.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+			return fmt.Errorf("addr: %v", err)
+		}
+	}
+
+	r := c.Routes
+	routes := []string{r.Slime, r.Duel, r.Stats, r.Login, r.Register, r.Origins}
+	for _, route := range routes {
+		if len(route) < 2 || route[0] != '/' || strings.HasSuffix(route, "/") {
+			return fmt.Errorf("route %q must start with / and not end with /", route)
+		}
+	}
+	routes = append(routes, r.Slime+"/n", r.Duel+"/n", r.Duel+"/bots", r.Duel+"/stats", r.Duel+"/replay")
+	seen := make(map[string]bool)
+	for _, route := range routes {
+		if seen[route] {
+			return fmt.Errorf("route %q is used twice", route)
+		}
+		seen[route] = true
+	}
+
+	if _, err := origin.New(c.Origins); err != nil {
+		return err
+	}
+	if c.AuthKey != "" && c.AuthFile == "" {
+		return errors.New("auth key is set without an auth file")
+	}
+	paths := []struct {
+		key, path string
+		kind      pathKind
+	}{
+		{"stats file", c.StatsFile, pathNewFile},
+		{"auth file", c.AuthFile, pathNewFile},
+		{"duel bot names", c.Duel.BotNames, pathFile},
+		{"duel skins", c.Duel.Skins, pathFile},
+		{"duel maps", c.Duel.Maps, pathDir},
+		{"duel replays", c.Duel.Replays, pathDir},
+	}
+	for _, p := range paths {
+		if err := checkPath(p.path, p.kind); err != nil {
+			return fmt.Errorf("%v: %v", p.key, err)
+		}
+	}
+	if err := c.slimeOptions().Validate(); err != nil {
+		return errors.New("slime: " + err.Error())
+	}
+	if err := c.duelOptions().Validate(); err != nil {
+		return errors.New("duel: " + err.Error())
+	}
+	if len(c.Duel.Arenas) >= duel.ARENA_MAX {
+		return fmt.Errorf("duel: at most %v arenas may be opened", duel.ARENA_MAX-1)
+	}
+	for name, a := range c.Duel.Arenas {
+		if !duel.ValidArenaName(name) || name == duel.ARENA_DEFAULT {
+			return fmt.Errorf("duel arena %q: invalid name", name)
+		}
+		if _, err := a.options(c.duelOptions()); err != nil {
+			return fmt.Errorf("duel arena %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// pathKind is what a configured path must be.
+type pathKind int
+
+const (
+	pathFile    pathKind = iota // an existing file
+	pathNewFile                 // a file, which is created if it does not exist
+	pathDir                     // an existing directory
+)
+
+// checkPath checks that a configured path, if it is not blank, is usable.
+func checkPath(path string, kind pathKind) error {
+	if path == "" {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if kind == pathNewFile && errors.Is(err, os.ErrNotExist) {
+		fi, err = os.Stat(filepath.Dir(path))
+		if err == nil && !fi.IsDir() {
+			err = fmt.Errorf("%v is not a directory", filepath.Dir(path))
+		}
+		return err
+	}
+	switch {
+	case err != nil:
+		return err
+	case kind == pathDir && !fi.IsDir():
+		return fmt.Errorf("%v is not a directory", path)
+	case kind != pathDir && fi.IsDir():
+		return fmt.Errorf("%v is a directory", path)
+	}
+	return nil
+}
+
+// slimeOptions returns the options of the slime server.
+func (c *Config) slimeOptions() slime.Options {
+	opt := slime.DefaultOptions()
+	opt.PhysFPS = c.Slime.PhysFPS
+	opt.NetFPS = c.Slime.NetFPS
+	opt.SendBuffer = c.Slime.SendBuffer
+	return opt
+}
+
+// duelOptions returns the options of duel arenas.
+func (c *Config) duelOptions() duel.Options {
+	opt := duel.DefaultOptions()
+	opt.PhysFPS = c.Duel.PhysFPS
+	opt.NetFPS = c.Duel.NetFPS
+	opt.MaxPlayers = c.Duel.MaxPlayers
+	opt.Population = c.Duel.Population
+	opt.SendBuffer = c.Duel.SendBuffer
+	opt.ResumeGrace = time.Duration(c.Duel.ResumeGrace) * time.Second
+	opt.ResumePilot = c.Duel.ResumePilot
+	opt.Streaks = c.Duel.Streaks
+	return opt
+}
+
+// originsFlag is the -origins flag, a comma-separated list of origin patterns,
+// each followed by "=spectate" if pages may only spectate.
+type originsFlag []origin.Policy
+
+func (f *originsFlag) String() string {
+	s := make([]string, len(*f))
+	for i, p := range *f {
+		s[i] = p.Origin
+		if p.SpectateOnly {
+			s[i] += "=spectate"
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *originsFlag) Set(value string) error {
+	*f = nil
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		var p origin.Policy
+		p.Origin, p.SpectateOnly = strings.CutSuffix(s, "=spectate")
+		if strings.Contains(p.Origin, "=") {
+			return fmt.Errorf("origin %q: unknown flag", s)
+		}
+		*f = append(*f, p)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package duel
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"victorz.ca/gameserv/auth"
+	"victorz.ca/gameserv/origin"
+)
+
+// Arena constants
+const (
+	// Name of the arena that is never shut down
+	ARENA_DEFAULT = "main"
+	// Maximum number of arenas
+	ARENA_MAX = 16
+	// Number of players in an arena before new players overflow into another
+	ARENA_PL = 64
+	// Maximum length of an arena name
+	ARENA_NAME_LEN = 16
+	// Time that an arena must be empty before it is shut down
+	ARENA_IDLE_TIME = 5 * time.Minute
+	// Interval of checks for idle arenas
+	ARENA_REAP_TIME = 30 * time.Second
+)
+
+// A Manager runs several arenas, each in its own goroutine.
+// A server should have one Manager instance,
+// and execute Manager.Run() in a new goroutine.
+type Manager struct {
+	arenas map[string]*Game
+	lock   sync.Mutex
+	nextID int
+	opt    Options // options for new arenas
+	closed bool
+
+	// AdminKey must be presented to change arenas over HTTP.
+	// If it is blank, arenas cannot be changed over HTTP.
+	AdminKey string
+
+	// ReplayDir is where replays are served from.
+	// If it is blank, replays cannot be watched.
+	ReplayDir string
+
+	// Auth identifies players with tokens, and protects the names of accounts.
+	// If it is nil, every player is anonymous.
+	Auth *auth.Auth
+
+	// Origins whose pages may connect to the arenas and replays.
+	// If it is nil, only pages from the same host may connect.
+	Origins *origin.Allowlist
+}
+
+// NewManager makes a Manager with a running default arena.
+// Arenas are started with the given options.
+func NewManager(opt Options) *Manager {
+	m := &Manager{
+		arenas: make(map[string]*Game),
+		nextID: 2,
+		opt:    opt,
+	}
+	m.open(ARENA_DEFAULT, m.opt, false)
+	return m
+}
+
+// Open starts an arena with its own options, which is never shut down when idle.
+// Players can only join it by name.
+func (m *Manager) Open(name string, opt Options) error {
+	if !ValidArenaName(name) {
+		return errors.New("invalid arena name: " + name)
+	}
+	if err := opt.Validate(); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.arenas[name] != nil {
+		return errors.New("arena already exists: " + name)
+	}
+	m.open(name, opt, true)
+	return nil
+}
+
+// open starts a new arena. The caller must hold m.lock.
+func (m *Manager) open(name string, opt Options, custom bool) *Game {
+	g := NewGame(name, opt)
+	g.custom = custom
+	m.arenas[name] = g
+	go g.Run()
+	return g
+}
+
+// names returns the sorted names of all arenas. The caller must hold m.lock.
+func (m *Manager) names() []string {
+	names := make([]string, 0, len(m.arenas))
+	for name := range m.arenas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidArenaName checks if a name can be used for an arena.
+func ValidArenaName(name string) bool {
+	if len(name) == 0 || len(name) > ARENA_NAME_LEN {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case (r >= '0' && r <= '9'),
+			(r >= 'a' && r <= 'z'),
+			r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Join adds a remote player to an arena.
+// If arena is not blank, the named arena is used, and started if needed.
+// Otherwise, the least-full arena without its own options is used,
+// and a new arena is started if all of them have at least ARENA_PL players,
+// or are full.
+// On failure, the returned Client is nil.
+func (m *Manager) Join(arena string, h *Hello) (*Game, *Client) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return nil, nil
+	}
+
+	if arena != "" {
+		g := m.arenas[arena]
+		if g == nil {
+			if !ValidArenaName(arena) || len(m.arenas) >= ARENA_MAX {
+				return nil, nil
+			}
+			g = m.open(arena, m.opt, false)
+		}
+		return g, g.AddPlayer(h)
+	}
+
+	// Find the least-full arena
+	var best *Game
+	bestN := 0
+	for _, arena := range m.names() {
+		g := m.arenas[arena]
+		if g.custom {
+			continue
+		}
+		n := g.NumPlayers()
+		if best == nil || n < bestN {
+			best = g
+			bestN = n
+		}
+	}
+
+	limit := ARENA_PL
+	if m.opt.MaxPlayers < limit {
+		limit = m.opt.MaxPlayers
+	}
+	if bestN >= limit && len(m.arenas) < ARENA_MAX {
+		// Overflow into a new arena
+		for m.arenas[strconv.Itoa(m.nextID)] != nil {
+			m.nextID++
+		}
+		best = m.open(strconv.Itoa(m.nextID), m.opt, false)
+		m.nextID++
+	}
+
+	return best, best.AddPlayer(h)
+}
+
+// Spectate adds a spectator to an arena.
+// If arena is blank, the arena with the most players is used.
+// On failure, the returned Client is nil.
+func (m *Manager) Spectate(arena string, follow int) (*Game, *Client) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	g := m.arenas[arena]
+	if arena == "" {
+		bestN := -1
+		for _, name := range m.names() {
+			if n := m.arenas[name].NumPlayers(); n > bestN {
+				g = m.arenas[name]
+				bestN = n
+			}
+		}
+	}
+	if g == nil {
+		return nil, nil
+	}
+	return g, g.AddSpectator(follow)
+}
+
+// Run is a loop that shuts down idle arenas forever.
+func (m *Manager) Run() {
+	for now := range time.Tick(ARENA_REAP_TIME) {
+		m.reap(now)
+	}
+}
+
+// reap shuts down arenas that have been idle for too long.
+func (m *Manager) reap(now time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return
+	}
+	for name, g := range m.arenas {
+		if name != ARENA_DEFAULT && !g.custom && g.idleTime(now) > ARENA_IDLE_TIME {
+			delete(m.arenas, name)
+			g.Stop()
+		}
+	}
+}
+
+// Close shuts down every arena, and waits until their replay files are finished.
+// It must be called at most once.
+func (m *Manager) Close() {
+	m.lock.Lock()
+	m.closed = true
+	games := make([]*Game, 0, len(m.arenas))
+	for _, g := range m.arenas {
+		games = append(games, g)
+		g.Stop()
+	}
+	m.lock.Unlock()
+
+	for _, g := range games {
+		g.Wait()
+	}
+}
+
+// Arena returns the arena with the given name, or nil if it does not exist.
+func (m *Manager) Arena(name string) *Game {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.arenas[name]
+}
+
+// games returns every arena, sorted by name.
+func (m *Manager) games() []*Game {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	games := make([]*Game, 0, len(m.arenas))
+	for _, name := range m.names() {
+		games = append(games, m.arenas[name])
+	}
+	return games
+}
+
+// Resume gives control of a disconnected player back to a new client,
+// in whichever arena the player is in.
+// On failure, the returned Client is nil.
+func (m *Manager) Resume(token string) (*Game, *Client) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, g := range m.arenas {
+		if c := g.ResumePlayer(token); c != nil {
+			return g, c
+		}
+	}
+	return nil, nil
+}
+
+// arenaCount is the number of players in an arena.
+type arenaCount struct {
+	name string
+	n    int // number of remote players
+	pop  int // target number of players and bots
+}
+
+// counts returns the number of players in each arena, sorted by name.
+func (m *Manager) counts() []arenaCount {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	counts := make([]arenaCount, 0, len(m.arenas))
+	for _, name := range m.names() {
+		g := m.arenas[name]
+		counts = append(counts, arenaCount{name, g.NumPlayers(), g.Population()})
+	}
+	return counts
+}
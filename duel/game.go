@@ -1,129 +1,409 @@
 package duel
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
 	"sync"
 	"time"
+
+	"victorz.ca/gameserv/auth"
+	"victorz.ca/gameserv/stats"
 )
 
 // Timing constants
 const (
-	// Physics frames per second
+	// Default physics frames per second
 	PHYS_FPS = 50
-	// Network world states per second
+	// Maximum physics frames per second
+	MAX_PHYS_FPS = 200
+	// Default network world states per second
 	NETW_FPS = 25
-	// Interval of physics frames
-	PHYS_TIME = time.Second / PHYS_FPS
-	// Interval of world state updates
-	NETW_TIME = time.Second / NETW_FPS
 	// Interval of pings
 	PING_TIME = 250 * time.Millisecond
+	// Interval of ping results
+	PING_REPORT_TIME = 1 * time.Second
+	// Interval of bot population adjustments
+	BOT_ADJUST_TIME = 1 * time.Second
 )
 
 // Limits
 const (
 	// Maximum number of players
 	MAX_PL = 256
-	// Target number of bots
-	BOT_BALANCE = 16
+	// Default number of messages queued for a client, enough for at least 2 seconds
+	SEND_BUFFER = 300
+	// Default target number of players and bots
+	POPULATION = 16
+	// Default fraction of a cell that must be covered to absorb it
+	COVER = 0.5
 )
 
-// A server should have one Game instance,
-// and execute Game.Run() in a new goroutine.
+// Options configure an arena.
+type Options struct {
+	// Target number of players and bots.
+	// Bots are added or removed over time to reach it.
+	Population int
+	// Number of player slots, from 1 to MAX_PL.
+	MaxPlayers int
+
+	// Physics frames per second, from 1 to MAX_PHYS_FPS.
+	PhysFPS int
+	// World states sent per second, from 1 to PhysFPS.
+	NetFPS int
+	// Number of messages queued for a client before it is disconnected.
+	SendBuffer int
+
+	// Number of teams, from 2 to MAX_TEAMS, or 0 for free-for-all.
+	Teams int
+
+	// How colliding cells are resolved.
+	Collision CollisionMode
+	// With CollideMass, the fraction of the diameter of the smaller cell
+	// that the larger cell must cover to absorb it, from 0 to 1.
+	Cover float64
+
+	// Maps to pick from at random when the arena starts, and between rounds,
+	// or none for DefaultMap.
+	Maps []*Map
+
+	// Length of a round, or 0 to play without rounds.
+	RoundTime time.Duration
+	// How the winner of a round is chosen.
+	RoundWin RoundWinMode
+
+	// Play a battle royale, where the playable region shrinks,
+	// and eliminated players wait until there is one survivor.
+	// It cannot be combined with RoundTime.
+	Royale bool
+
+	// Directory where replays of the arena are recorded, or blank to not record.
+	ReplayDir string
+
+	// Where the statistics of players are recorded, or nil.
+	Store stats.Store
+	// Accounts whose names bots may not use, or nil.
+	Auth *auth.Auth
+
+	// Milestones of kills without dying that are announced and rewarded,
+	// in increasing order.
+	Streaks []Streak
+
+	// Time that the slot of a disconnected player is kept for it to resume,
+	// or 0 to remove disconnected players immediately.
+	ResumeGrace time.Duration
+	// Let bots control disconnected players until they resume.
+	ResumePilot bool
+}
+
+// Validate checks that the options are usable.
+func (opt Options) Validate() error {
+	if opt.MaxPlayers < 1 || opt.MaxPlayers > MAX_PL {
+		return fmt.Errorf("max players must be from 1 to %v", MAX_PL)
+	}
+	if opt.Population < 0 || opt.Population > opt.MaxPlayers {
+		return fmt.Errorf("population must be from 0 to %v", opt.MaxPlayers)
+	}
+	if opt.PhysFPS < 1 || opt.PhysFPS > MAX_PHYS_FPS {
+		return fmt.Errorf("phys fps must be from 1 to %v", MAX_PHYS_FPS)
+	}
+	if opt.NetFPS < 1 || opt.NetFPS > opt.PhysFPS {
+		return fmt.Errorf("net fps must be from 1 to %v", opt.PhysFPS)
+	}
+	if opt.SendBuffer < 1 {
+		return fmt.Errorf("send buffer must be at least 1")
+	}
+	if opt.Teams != 0 && (opt.Teams < 2 || opt.Teams > MAX_TEAMS) {
+		return fmt.Errorf("teams must be 0, or from 2 to %v", MAX_TEAMS)
+	}
+	if opt.Collision > CollideMass {
+		return fmt.Errorf("unknown collision mode %v", opt.Collision)
+	}
+	if opt.Cover < 0 || opt.Cover > 1 {
+		return fmt.Errorf("cover must be from 0 to 1")
+	}
+	if opt.RoundTime < 0 {
+		return fmt.Errorf("round time must not be negative")
+	}
+	if opt.RoundWin > WinByMass {
+		return fmt.Errorf("unknown round win mode %v", opt.RoundWin)
+	}
+	if opt.ResumeGrace < 0 || opt.ResumeGrace > MAX_RESUME_GRACE {
+		return fmt.Errorf("resume grace must be from 0 to %v", MAX_RESUME_GRACE)
+	}
+	if opt.Royale && opt.RoundTime != 0 {
+		return fmt.Errorf("battle royale cannot be played in timed rounds")
+	}
+	if err := validateStreaks(opt.Streaks); err != nil {
+		return err
+	}
+	for _, m := range opt.Maps {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("map %v: %v", m.Name, err)
+		}
+	}
+	return nil
+}
+
+// DefaultOptions returns the options used for arenas that are not configured.
+func DefaultOptions() Options {
+	return Options{
+		Population:  POPULATION,
+		MaxPlayers:  MAX_PL,
+		PhysFPS:     PHYS_FPS,
+		NetFPS:      NETW_FPS,
+		SendBuffer:  SEND_BUFFER,
+		Collision:   CollideRandom,
+		Cover:       COVER,
+		Streaks:     defaultStreaks,
+		ResumeGrace: RESUME_GRACE,
+	}
+}
+
+// A Game is a single arena. It is normally created by a Manager,
+// which executes Game.Run() in a new goroutine.
 type Game struct {
-	players [MAX_PL]Player
-	pLock   sync.Mutex
+	name   string
+	stop   chan struct{}
+	done   chan struct{} // closed when Run returns
+	custom bool          // has its own options, so it is only joined by name
+
+	players    [MAX_PL]Player
+	spectators map[*Client]struct{}
+	pLock      sync.Mutex
+
+	population int // target number of players and bots
+	maxPlayers int // number of slots that may be used
+	physFPS    float64
+	physTime   time.Duration // interval of physics frames
+	netTime    time.Duration
+	sendBuffer int
+	teams      int // number of teams, or 0
+	collision  CollisionMode
+	cover      float64
+	m          *Map
+	maps       []*Map
+	roundTime  time.Duration
+	roundWin   RoundWinMode
+
+	royale      bool
+	zone        royaleZone
+	royaleCount int   // number of players taking part
+	royaleOut   []int // eliminated players, in order
+
+	streaks []Streak
+
+	replayDir string
+	store     stats.Store
+	auth      *auth.Auth
+	rec       *recorder   // nil when not recording
+	finishing []*recorder // stopped, and still being written
+
+	resumeGrace time.Duration
+	resumePilot bool
+
+	snapshots [SNAPSHOT_HISTORY]snapshot
+	seq       uint32 // number of the next snapshot
+
+	food        [MAX_FOOD]Food
+	foodAdded   []int   // pellets added since the last broadcast
+	foodEaten   []int   // pellets removed since the last broadcast
+	foodMoved   []int   // pellets moved since the last broadcast
+	foodRespawn float64 // pellets due to respawn
 
-	pCount     int // current number of players
+	pCount     int       // current number of players
+	idleSince  time.Time // when pCount last became zero
 	pCountLock sync.Mutex
 
+	frame        uint64  // number of physics frames
+	splitDamping float64 // fraction of split velocity kept each frame
+
+	stats         TickStats
+	statsLock     sync.Mutex
+	unloggedDrops uint64    // frames dropped since the last log
+	skippedState  bool      // the last world state that was due was skipped
+	nextDropLog   time.Time // when dropped frames may be logged again
+
 	gameStart      time.Time
 	lastPhysics    time.Time
 	lastWorldState time.Time
 	nextPing       time.Time
+	nextPingReport time.Time
+	nextBotAdjust  time.Time
+	nextTeamScore  time.Time
+	roundEnd       time.Time // when the current round ends
+	pauseEnd       time.Time // when the pause between rounds ends, or zero
+	nextCountdown  time.Time
 }
 
-func NewGame() Game {
-	var g Game
-	for i := 0; i < BOT_BALANCE; i++ {
-		g.players[i].InitBot()
+// NewGame makes a new arena with the given name and options.
+func NewGame(name string, opt Options) *Game {
+	g := &Game{
+		name:       name,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		idleSince:  time.Now(),
+		spectators: make(map[*Client]struct{}),
+	}
+	g.maxPlayers = opt.MaxPlayers
+	g.population = g.clampPopulation(opt.Population)
+	g.physFPS = float64(opt.PhysFPS)
+	g.physTime = time.Second / time.Duration(opt.PhysFPS)
+	g.splitDamping = math.Pow(SPLIT_DAMPING, float64(g.physTime)/float64(SPLIT_DAMPING_TIME))
+	g.netTime = time.Second / time.Duration(opt.NetFPS)
+	g.sendBuffer = opt.SendBuffer
+	g.teams = opt.Teams
+	g.collision = opt.Collision
+	g.cover = opt.Cover
+	g.m = DefaultMap()
+	g.maps = opt.Maps
+	if len(g.maps) != 0 {
+		g.m = g.maps[rand.Intn(len(g.maps))]
+	}
+	g.roundTime = opt.RoundTime
+	g.roundWin = opt.RoundWin
+	g.royale = opt.Royale
+	g.streaks = opt.Streaks
+	g.replayDir = opt.ReplayDir
+	g.store = opt.Store
+	g.auth = opt.Auth
+	g.resumeGrace = opt.ResumeGrace
+	g.resumePilot = opt.ResumePilot
+	for i := 0; i < g.population; i++ {
+		g.players[i].InitBot(g.botName())
+		g.assignTeam(&g.players[i])
 	}
+	if g.royale {
+		g.startRoyale()
+	}
+	g.fillFood()
 	return g
 }
 
+// Name returns the name of the arena.
+func (g *Game) Name() string { return g.name }
+
+// NumPlayers returns the current number of remote players.
+func (g *Game) NumPlayers() int {
+	g.pCountLock.Lock()
+	defer g.pCountLock.Unlock()
+	return g.pCount
+}
+
+// idleTime returns how long the arena has had no remote players.
+func (g *Game) idleTime(now time.Time) time.Duration {
+	g.pCountLock.Lock()
+	defer g.pCountLock.Unlock()
+	if g.pCount != 0 {
+		return 0
+	}
+	return now.Sub(g.idleSince)
+}
+
 // AddPlayer adds a remotely-controlled player to the game and returns a Client,
 // or nil on failure.
-func (g *Game) AddPlayer(name []byte, col uint8) *Client {
+// An empty slot is used if possible. Otherwise, the smallest bot is replaced.
+func (g *Game) AddPlayer(h *Hello) *Client {
 	g.pLock.Lock()
 	defer g.pLock.Unlock()
 
-	for i := range g.players {
-		p := &g.players[i]
-		if !p.IsValid || p.Client == nil {
-			p.InitPlayer(name, col)
-
-			p.Client = newClient(g, i)
-
-			p.Client.SendB(MsgWelcome(i))
-			msg := PrepareMessage(MsgEnter(i, p.Color, 0, 0, 0, 0, p.Name))
-			for j := range g.players {
-				pp := &g.players[j]
-				if i == j || !pp.IsValid {
-					continue
-				} else if pp.Client != nil {
-					p.Client.SendB(MsgEnter(
-						j, pp.Color,
-						pp.Kills, pp.Deaths, pp.Combo, pp.Score,
-						pp.Name,
-					))
-					pp.Client.Send(msg)
-				} else {
-					p.Client.SendB(MsgEnterBot(
-						j, pp.Color,
-						pp.Kills, pp.Deaths, pp.Combo, pp.Score,
-						pp.Name,
-					))
-				}
-			}
+	i := -1
+	for j := range g.players[:g.maxPlayers] {
+		if !g.players[j].IsValid {
+			i = j
+			break
+		}
+	}
+	if i == -1 {
+		i = g.smallestBot()
+		if i == -1 {
+			return nil
+		}
+		g.removeBot(i)
+	}
 
-			g.pCountLock.Lock()
-			defer g.pCountLock.Unlock()
-			g.pCount++
+	p := &g.players[i]
+	p.InitPlayer([]byte(h.Name), h.id, h.Color, skinID(h.Skin))
+	p.input = h.inputMode()
+	p.ResumeToken = newResumeToken()
+	g.assignTeam(p)
+	g.joinRoyale(p)
 
-			return p.Client
-		}
+	// Announce the player to everyone else
+	g.broadcastColors(func(rgb bool) []byte { return MsgEnter(i, p, rgb) })
+
+	p.Client = newClient(g, i)
+	p.Client.rgb = h.rgb
+	p.Client.delta = h.Delta
+	p.Client.SendB(MsgWelcome(i, p.input))
+	if h.rgb {
+		p.Client.SendB(MsgResumeToken(p.ResumeToken))
 	}
+	g.sendState(p.Client.SendB, i, h.rgb)
 
-	return nil
+	g.pCountLock.Lock()
+	defer g.pCountLock.Unlock()
+	g.pCount++
+
+	return p.Client
 }
 
 // DelPlayer removes a player from the game.
+// Bots are added back over time if the arena is below its target population.
 func (g *Game) DelPlayer(cn int) {
 	g.pLock.Lock()
 	defer g.pLock.Unlock()
 
+	g.delPlayer(cn)
+}
+
+// delPlayer removes a player from the game. The caller must hold g.pLock.
+func (g *Game) delPlayer(cn int) {
 	p := &g.players[cn]
 	if p.IsValid {
+		g.recordPeak(p)
+		g.leaveRoyale(p)
 		p.Reset()
+		g.clearKiller(cn)
 	}
 
-	var msg []byte
 	g.pCountLock.Lock()
 	defer g.pCountLock.Unlock()
 	g.pCount--
-
-	if g.pCount < BOT_BALANCE {
-		// Replace with bot
-		p.InitBot()
-		msg = MsgEnterBot(cn, p.Color, 0, 0, 0, 0, p.Name)
-	} else {
-		// Remove player
-		msg = MsgLeave(cn)
+	if g.pCount == 0 {
+		g.idleSince = time.Now()
 	}
 
-	g.Broadcast(msg)
+	g.Broadcast(MsgLeave(cn))
+}
+
+// sendState sends everything that a new client needs to know about the arena:
+// the map, round, zone, food, and every player other than self.
+func (g *Game) sendState(send func([]byte), self int, rgb bool) {
+	send(MsgMap(g.m))
+	if rgb && len(skins) != 0 {
+		send(MsgSkins())
+	}
+	if g.roundTime != 0 {
+		send(g.roundState(time.Now()))
+	}
+	if g.royale {
+		send(MsgZone(&g.zone))
+	}
+	send(MsgFoodSnapshot(g))
+	for j := range g.players {
+		pp := &g.players[j]
+		if j == self || !pp.IsValid {
+			continue
+		} else if pp.Client != nil {
+			send(MsgEnter(j, pp, rgb))
+		} else {
+			send(MsgEnterBot(j, pp, rgb))
+		}
+	}
 }
 
-// Broadcast sends a message to all players
+// Broadcast sends a message to all players and spectators
 func (g *Game) Broadcast(msg []byte) {
 	pm := PrepareMessage(msg)
 	for i := range g.players {
@@ -132,25 +412,78 @@ func (g *Game) Broadcast(msg []byte) {
 			p.Client.Send(pm)
 		}
 	}
+	for c := range g.spectators {
+		c.Send(pm)
+	}
+	if g.rec != nil {
+		g.rec.record(msg)
+	}
+}
+
+// broadcastColors sends a message with player or team colors to all players
+// and spectators, in the layout that each client understands (see Hello).
+// Spectators and replays get 24-bit colors.
+func (g *Game) broadcastColors(msg func(rgb bool) []byte) {
+	full := msg(true)
+	pmRGB, pmPalette := PrepareMessage(full), PrepareMessage(msg(false))
+	for i := range g.players {
+		p := &g.players[i]
+		if !p.IsValid || p.Client == nil {
+			continue
+		} else if p.Client.rgb {
+			p.Client.Send(pmRGB)
+		} else {
+			p.Client.Send(pmPalette)
+		}
+	}
+	for c := range g.spectators {
+		c.Send(pmRGB)
+	}
+	if g.rec != nil {
+		g.rec.record(full)
+	}
 }
 
 // serverslice periodically runs, and runs needed processing for the game.
-func (g *Game) serverslice() {
+// It returns when the next physics frame or world state is due.
+func (g *Game) serverslice() time.Time {
 	g.pLock.Lock()
 	defer g.pLock.Unlock()
 
 	now := time.Now()
 
-	// Apply physics
-	if now.After(g.lastPhysics) {
-		g.PhysicsFrame()
-		g.lastPhysics = g.lastPhysics.Add(PHYS_TIME)
+	// Apply physics, unless paused between rounds.
+	// Frames that are late are caught up, so the game runs at a fixed rate.
+	frames, lag := g.runPhysics(now)
+
+	// Start and end rounds
+	if g.roundTime != 0 {
+		g.updateRound(now)
+	} else if g.royale {
+		g.updateRoyale(now)
 	}
 
-	// Send world state
+	// Send world state, unless catching up.
+	// Late world states are not caught up, since only the latest one matters.
+	// At most one state in a row is skipped, so clients keep getting
+	// states while the arena is constantly catching up.
+	skipped := false
 	if now.After(g.lastWorldState) {
-		g.Broadcast(buildWorldState(g))
-		g.lastWorldState = g.lastWorldState.Add(NETW_TIME)
+		if frames > 1 && !g.skippedState {
+			skipped = true
+		} else {
+			g.broadcastFood()
+			g.broadcastWorldState()
+			if g.royale {
+				g.Broadcast(MsgZone(&g.zone))
+			}
+			g.updateSpectators()
+		}
+		g.skippedState = skipped
+		g.lastWorldState = g.lastWorldState.Add(g.netTime)
+		if g.lastWorldState.Before(now) {
+			g.lastWorldState = now.Add(g.netTime)
+		}
 	}
 
 	// Send pings and ping results
@@ -158,18 +491,82 @@ func (g *Game) serverslice() {
 		g.Broadcast(MsgPing())
 		g.nextPing = now.Add(PING_TIME)
 	}
+	if now.After(g.nextPingReport) {
+		g.Broadcast(MsgPingTimes(g))
+		g.nextPingReport = now.Add(PING_REPORT_TIME)
+	}
+
+	// Send team scores
+	if g.teams != 0 && now.After(g.nextTeamScore) {
+		scores := g.teamScores()
+		g.broadcastColors(func(rgb bool) []byte { return MsgTeamScores(scores, rgb) })
+		g.nextTeamScore = now.Add(TEAM_SCORE_TIME)
+	}
+
+	// Add or remove a bot, remove disconnected players, and start a new replay file
+	if now.After(g.nextBotAdjust) {
+		g.expireDetached(now)
+		if g.rec != nil && now.Sub(g.rec.start) > REPLAY_MAX_TIME {
+			g.rotateRecording()
+		}
+		g.adjustBots()
+		g.nextBotAdjust = now.Add(BOT_ADJUST_TIME)
+	}
+
+	g.recordSlice(frames, skipped, lag, time.Since(now))
+	if g.lastWorldState.Before(g.lastPhysics) {
+		return g.lastWorldState
+	}
+	return g.lastPhysics
 }
 
-// Run is a loop that runs the game forever.
+// Run is a loop that runs the game until Stop is called.
 func (g *Game) Run() {
+	defer close(g.done)
+
 	// timers
 	now := time.Now()
 	g.gameStart = now
 	g.lastPhysics = now
 	g.lastWorldState = now
 	g.nextPing = now
+	g.nextPingReport = now
+	g.nextBotAdjust = now
+	g.nextTeamScore = now
+	g.roundEnd = now.Add(g.roundTime)
+	g.nextCountdown = now
+	if g.replayDir != "" {
+		g.pLock.Lock()
+		g.startRecording(g.replayDir)
+		g.pLock.Unlock()
+	}
 	for {
-		g.serverslice()
-		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-g.stop:
+			g.closeSpectators()
+			g.pLock.Lock()
+			g.stopRecording()
+			g.pLock.Unlock()
+			g.finishRecordings()
+			return
+		default:
+		}
+		next := g.serverslice()
+		g.finishRecordings()
+		if d := time.Until(next); d > SLICE_TIME {
+			time.Sleep(SLICE_TIME)
+		} else if d > 0 {
+			time.Sleep(d)
+		}
 	}
 }
+
+// Stop makes Run return. It must be called at most once.
+func (g *Game) Stop() {
+	close(g.stop)
+}
+
+// Wait waits until Run returns, after Stop is called.
+func (g *Game) Wait() {
+	<-g.done
+}
@@ -0,0 +1,135 @@
+package duel
+
+import (
+	"math"
+	"time"
+)
+
+// Ability constants
+const (
+	// Maximum number of cells per player
+	PL_CELLS_MAX = 8
+
+	// Minimum mass of a cell that can split
+	SPLIT_MASS_MIN = 2 * PL_MASS_MIN
+	// Speed of a new cell after splitting (per second)
+	SPLIT_SPEED = 800.0
+	// Fraction of velocity after splitting that is kept each SPLIT_DAMPING_TIME
+	SPLIT_DAMPING      = 0.9
+	SPLIT_DAMPING_TIME = 20 * time.Millisecond
+	// Time before split cells may merge
+	SPLIT_MERGE_TIME = 10 * time.Second
+	// Time between splits
+	SPLIT_COOLDOWN = 500 * time.Millisecond
+
+	// Mass of an ejected chunk (must fit in a byte)
+	EJECT_MASS = 48
+	// Minimum mass of a cell that can eject
+	EJECT_MASS_MIN = PL_MASS_MIN + EJECT_MASS
+	// Speed of an ejected chunk, which slows down like a split cell (per second)
+	EJECT_SPEED = 750.0
+	// Time between ejects
+	EJECT_COOLDOWN = 100 * time.Millisecond
+)
+
+// useAbilities splits or ejects mass if the player asked to,
+// and the ability is ready.
+func (g *Game) useAbilities(p *Player) {
+	if p.wantSplit {
+		p.wantSplit = false
+		if g.frame >= p.nextSplit {
+			g.splitPlayer(p)
+			p.nextSplit = g.frame + g.frames(SPLIT_COOLDOWN)
+		}
+	}
+	if p.wantEject {
+		p.wantEject = false
+		if g.frame >= p.nextEject {
+			g.ejectPlayer(p)
+			p.nextEject = g.frame + g.frames(EJECT_COOLDOWN)
+		}
+	}
+}
+
+// splitPlayer splits every large enough cell in two,
+// launching the new halves in the direction of movement.
+func (g *Game) splitPlayer(p *Player) {
+	n := len(p.Cells)
+	for i := 0; i < n && len(p.Cells) < PL_CELLS_MAX; i++ {
+		c := &p.Cells[i]
+		if c.M < SPLIT_MASS_MIN {
+			continue
+		}
+
+		half := c.M / 2
+		c.setMass(c.M - half)
+		c.mergeFrame = g.frame + g.frames(SPLIT_MERGE_TIME)
+
+		nc := Cell{
+			O:          c.O,
+			V:          p.heading.Mul(SPLIT_SPEED),
+			mergeFrame: c.mergeFrame,
+		}
+		nc.setMass(half)
+		p.Cells = append(p.Cells, nc)
+	}
+}
+
+// ejectPlayer fires a chunk of mass from every large enough cell
+// in the direction of movement, as a food pellet that slides to a stop.
+func (g *Game) ejectPlayer(p *Player) {
+	for i := range p.Cells {
+		c := &p.Cells[i]
+		if c.M < EJECT_MASS_MIN {
+			continue
+		}
+
+		id := g.freeFood()
+		if id == -1 {
+			return
+		}
+		r := math.Sqrt(EJECT_MASS)
+		o := c.O.Add(p.heading.Mul(c.R + r))
+		g.addFood(id, g.m.pushOut(o, r), EJECT_MASS)
+		g.food[id].V = p.heading.Mul(EJECT_SPEED)
+		c.setMass(c.M - EJECT_MASS)
+	}
+}
+
+// mergeCells pushes apart the cells of a player,
+// or merges them once they are allowed to.
+func (g *Game) mergeCells(p *Player) {
+	for i := 0; i < len(p.Cells); i++ {
+		for j := i + 1; j < len(p.Cells); j++ {
+			a, b := &p.Cells[i], &p.Cells[j]
+			diff := b.O.Sub(a.O)
+			dist := a.R + b.R
+			dist2 := diff.LengthSquared()
+			if dist2 >= dist*dist {
+				continue
+			}
+
+			if g.frame >= a.mergeFrame && g.frame >= b.mergeFrame {
+				// Merge when the centers are close enough
+				if dist2 <= a.R*a.R || dist2 <= b.R*b.R {
+					a.addMass(b.M)
+					a.O = a.O.Add(diff.Mul(float64(b.M) / float64(a.M)))
+					p.removeCell(j)
+					j--
+				}
+				continue
+			}
+
+			// Push both cells apart equally
+			l := diff.Length()
+			if l == 0 {
+				diff = randomDir()
+			} else {
+				diff = diff.Div(l)
+			}
+			push := diff.Mul((dist - l) / 2)
+			a.O = g.m.pushOut(a.O.Sub(push), a.R)
+			b.O = g.m.pushOut(b.O.Add(push), b.R)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package duel
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"victorz.ca/gameserv/auth"
+)
+
+// Bot constants
+const (
+	// Distance that a fleeing bot aims to travel
+	BOT_FLEE_RANGE = 300.0
+	// Maximum distance of a wander destination
+	BOT_WANDER_RANGE = 400.0
+	// Time before a wandering bot picks a new destination
+	BOT_WANDER_TIME = 5 * time.Second
+)
+
+// BotPersonality describes how a bot plays.
+type BotPersonality struct {
+	// Time between decisions
+	Think time.Duration
+	// Distance within which other players are noticed
+	Vision float64
+	// Gap to a larger player at which the bot flees
+	FleeDist float64
+	// Fraction of the prey's movement that is predicted when chasing
+	Lead float64
+	// Largest mass of prey to chase, as a fraction of the bot's mass
+	Greed float64
+}
+
+// botPersonalities are assigned to bots at random, so the mix is varied.
+var botPersonalities = [...]BotPersonality{
+	// Timid: flees early, and only chases small prey
+	{Think: 300 * time.Millisecond, Vision: 350, FleeDist: 250, Lead: 0.2, Greed: 0.5},
+	// Casual: slow to react, and chases blindly
+	{Think: 500 * time.Millisecond, Vision: 300, FleeDist: 100, Lead: 0, Greed: 0.8},
+	// Hunter: intercepts prey, and takes some risks
+	{Think: 160 * time.Millisecond, Vision: 500, FleeDist: 150, Lead: 0.8, Greed: 0.95},
+	// Expert: reacts quickly, and sees threats from afar
+	{Think: 80 * time.Millisecond, Vision: 600, FleeDist: 200, Lead: 1, Greed: 0.95},
+}
+
+// botNames are the names given to bots.
+var botNames = []string{
+	"Blob", "Goo", "Bubble", "Droplet", "Jelly", "Mochi", "Pudding", "Dumpling",
+	"Nebula", "Comet", "Pixel", "Orbit", "Marble", "Pebble", "Button", "Biscuit",
+	"Noodle", "Waffle", "Gizmo", "Sprocket", "Wobble", "Squish", "Puddle", "Glob",
+	"Muffin", "Taffy", "Kiwi", "Olive", "Pepper", "Ziggy", "Bloop", "Splat",
+}
+
+// LoadBotNames replaces the names given to bots with the names in a file,
+// one per line. Blank lines and lines starting with # are ignored.
+// It must be called before any arena is started.
+func LoadBotNames(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var names []string
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Bytes()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		name := filterName(line)
+		// Guest names are always reserved, so bots could never use them
+		if strings.HasPrefix(strings.ToLower(name), auth.GUEST_PREFIX) {
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return errors.New("no bot names in " + path)
+	}
+
+	botNames = names
+	return nil
+}
+
+// botName picks a name for a bot that is not used by another player in the arena,
+// and does not belong to an account.
+func (g *Game) botName() string {
+	used := make(map[string]bool)
+	for i := range g.players {
+		p := &g.players[i]
+		if p.IsValid {
+			used[p.Name] = true
+		}
+	}
+
+	start := rand.Intn(len(botNames))
+	for i := range botNames {
+		name := botNames[(start+i)%len(botNames)]
+		if !used[name] && !g.auth.Reserved(name) {
+			return name
+		}
+	}
+
+	// All names are taken, so add a number
+	for n := 2; ; n++ {
+		suffix := " " + strconv.Itoa(n)
+		name := botNames[start]
+		if len(name)+len(suffix) > MAX_NAME_LEN {
+			name = name[:MAX_NAME_LEN-len(suffix)]
+		}
+		name += suffix
+		if !used[name] && !g.auth.Reserved(name) {
+			return name
+		}
+	}
+}
+
+type botBehaviour uint8
+
+// Bot behaviours
+const (
+	botWander botBehaviour = iota
+	botForage
+	botChase
+	botFlee
+)
+
+// botState is the state of a bot-controlled Player.
+type botState struct {
+	*BotPersonality
+	behaviour botBehaviour
+	divider   int // frames until next decision
+	wander    int // frames until next wander destination
+}
+
+// randomDir returns a random unit vector.
+func randomDir() Vec2 {
+	a := rand.Float64() * 2 * math.Pi
+	return Vec2{math.Cos(a), math.Sin(a)}
+}
+
+// botIntercept returns where a bot should head to catch its prey,
+// assuming the prey keeps moving towards its destination.
+func botIntercept(g *Game, p, prey *Player, lead float64) Vec2 {
+	// Time needed to reach the prey's current position
+	t := prey.O.Sub(p.O).Length() / PL_SPEED
+	ahead := prey.D.Sub(prey.O)
+	reach := PL_SPEED * t * lead
+	if l := ahead.Length(); l > reach {
+		ahead = ahead.Mul(reach / l)
+	}
+	return g.m.clamp(prey.O.Add(ahead))
+}
+
+// botWanderPlayer moves a bot towards a random nearby destination,
+// picking a new one when it arrives or gets bored.
+func botWanderPlayer(g *Game, p *Player) {
+	b := &p.bot
+	if b.behaviour == botWander && b.wander > 0 &&
+		p.D.Sub(p.O).LengthSquared() > p.R*p.R {
+		b.wander--
+		return
+	}
+	b.behaviour = botWander
+	b.wander = int(g.frames(BOT_WANDER_TIME))
+	p.D = g.m.clamp(p.O.Add(randomDir().Mul(rand.Float64() * BOT_WANDER_RANGE)))
+}
+
+func botThinkPlayer(g *Game, p *Player) {
+	b := &p.bot
+	if b.divider > 0 {
+		b.divider--
+		if b.behaviour == botWander {
+			botWanderPlayer(g, p)
+		}
+		return
+	}
+	think := int(g.frames(b.Think))
+	b.divider = think + rand.Intn(think+1)
+
+	// Get back inside the zone before anything else
+	if g.royale && !g.inZone(p.O) {
+		b.behaviour = botFlee
+		p.D = g.zone.O
+		return
+	}
+
+	// Flee away from threats, weighted by closeness,
+	// or chase the prey with the most mass for its distance
+	var flee Vec2
+	fleeing := false
+	var prey *Player
+	preyScore := 0.0
+	for i := range g.players {
+		pp := &g.players[i]
+		if !pp.IsAlive || p == pp || sameTeam(p, pp) {
+			continue
+		}
+		diff := p.O.Sub(pp.O)
+		gap := math.Max(diff.Length()-p.R-pp.R, 1)
+		if gap > b.Vision {
+			continue
+		}
+		if pp.M > p.M {
+			if gap < b.FleeDist {
+				if diff.LengthSquared() != 0 {
+					flee = flee.Add(diff.Normalize().Div(gap))
+				}
+				fleeing = true
+			}
+		} else if float64(pp.M) <= float64(p.M)*b.Greed {
+			score := float64(pp.M) / gap
+			if preyScore < score {
+				prey = pp
+				preyScore = score
+			}
+		}
+	}
+
+	switch {
+	case fleeing:
+		b.behaviour = botFlee
+		// Avoid being cornered against the edges of the arena
+		flee.X += 1/math.Max(p.O.X, 1) - 1/math.Max(g.m.W-p.O.X, 1)
+		flee.Y += 1/math.Max(p.O.Y, 1) - 1/math.Max(g.m.H-p.O.Y, 1)
+		if flee.LengthSquared() == 0 {
+			flee = randomDir()
+		}
+		p.D = g.m.clamp(p.O.Add(flee.Normalize().Mul(BOT_FLEE_RANGE)))
+	case prey != nil:
+		b.behaviour = botChase
+		p.D = botIntercept(g, p, prey, b.Lead)
+	default:
+		if f := g.nearestFood(p.O, b.Vision); f != nil {
+			b.behaviour = botForage
+			p.D = f.O
+		} else {
+			botWanderPlayer(g, p)
+		}
+	}
+}
+
+// clampPopulation limits a target population to the number of slots.
+func (g *Game) clampPopulation(n int) int {
+	if n < 0 {
+		return 0
+	} else if n > g.maxPlayers {
+		return g.maxPlayers
+	}
+	return n
+}
+
+// Population returns the target number of players and bots.
+func (g *Game) Population() int {
+	g.pLock.Lock()
+	defer g.pLock.Unlock()
+	return g.population
+}
+
+// SetPopulation changes the target number of players and bots.
+// Bots are added or removed gradually to reach it.
+func (g *Game) SetPopulation(n int) {
+	g.pLock.Lock()
+	defer g.pLock.Unlock()
+	g.population = g.clampPopulation(n)
+}
+
+// smallestBot returns the client number of the bot that is the least
+// costly to remove (dead, or with the least mass), or -1 if there are no bots.
+func (g *Game) smallestBot() int {
+	best := -1
+	var bestM uint
+	for i := range g.players {
+		p := &g.players[i]
+		if !p.IsValid || p.Client != nil {
+			continue
+		}
+		m := p.M
+		if !p.IsAlive {
+			m = 0
+		}
+		if best == -1 || m < bestM {
+			best = i
+			bestM = m
+		}
+	}
+	return best
+}
+
+// removeBot removes a bot from the game. The caller must hold g.pLock.
+func (g *Game) removeBot(cn int) {
+	p := &g.players[cn]
+	g.leaveRoyale(p)
+	p.Reset()
+	g.clearKiller(cn)
+	g.Broadcast(MsgLeave(cn))
+}
+
+// adjustBots adds or removes one bot to approach the target population.
+func (g *Game) adjustBots() {
+	humans, bots := 0, 0
+	free := -1
+	for i := range g.players[:g.maxPlayers] {
+		p := &g.players[i]
+		switch {
+		case !p.IsValid:
+			if free == -1 {
+				free = i
+			}
+		case p.Client != nil:
+			humans++
+		default:
+			bots++
+		}
+	}
+
+	want := g.population - humans
+	if want < 0 {
+		want = 0
+	}
+
+	if bots > want {
+		g.removeBot(g.smallestBot())
+	} else if bots < want && free != -1 {
+		p := &g.players[free]
+		p.InitBot(g.botName())
+		g.assignTeam(p)
+		g.joinRoyale(p)
+		g.broadcastColors(func(rgb bool) []byte { return MsgEnterBot(free, p, rgb) })
+	}
+}
@@ -41,18 +41,26 @@ type Client struct {
 	sendBuf chan<- WSWriter
 	lock    sync.Mutex
 	ping    uint16
+
+	rgb   bool  // understands 24-bit colors and skins (see Hello)
+	delta bool  // receives MsgWorldDelta instead of full world states
+	acked int64 // number of the last snapshot acknowledged, or -1
+
+	spec   bool // spectator, without a player slot
+	follow int  // for spectators: client number, FOLLOW_FREE or FOLLOW_LEADER
+	target int  // for spectators: client number last sent in MsgFollow
 }
 
 // newClient makes a new Client for a specific game and client number.
 func newClient(g *Game, cn int) *Client {
-	sendBuf := make(chan WSWriter, 300) // enough for at least 2 seconds
+	sendBuf := make(chan WSWriter, g.sendBuffer)
 	return &Client{
-		g,
-		cn,
-		sendBuf,
-		sendBuf,
-		sync.Mutex{},
-		0xFFFF,
+		g:       g,
+		cn:      cn,
+		SendBuf: sendBuf,
+		sendBuf: sendBuf,
+		ping:    0xFFFF,
+		acked:   -1,
 	}
 }
 
@@ -69,8 +77,10 @@ func (c *Client) Send(msg WSWriter) {
 	select {
 	case c.sendBuf <- msg:
 	default:
-		// send queue overflow
-		c.Close()
+		// send queue overflow:
+		// the caller may hold the game lock, so leave the game later
+		cn := c.closeLocked()
+		go c.leave(cn)
 	}
 }
 
@@ -83,11 +93,31 @@ func (c *Client) SendB(msg []byte) {
 // It is safe to call Close multiple times.
 func (c *Client) Close() {
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	cn := c.closeLocked()
+	c.lock.Unlock()
+
+	c.leave(cn)
+}
 
-	if c.cn != -1 {
+// closeLocked closes the send queue, and returns the previous client number,
+// which is -1 if it was already closed. The caller must hold c.lock.
+func (c *Client) closeLocked() int {
+	cn := c.cn
+	if cn != -1 {
 		close(c.sendBuf)
-		c.g.DelPlayer(c.cn)
 		c.cn = -1
 	}
+	return cn
+}
+
+// leave removes the client from the game, or keeps its player for it to resume,
+// unless it was already closed.
+func (c *Client) leave(cn int) {
+	switch {
+	case cn == -1:
+	case c.spec:
+		c.g.DelSpectator(c)
+	default:
+		c.g.detachPlayer(c, cn)
+	}
 }
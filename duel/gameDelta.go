@@ -0,0 +1,121 @@
+package duel
+
+// Delta constants
+const (
+	// Number of world states kept for delta encoding (at most 256)
+	SNAPSHOT_HISTORY = 64
+)
+
+// cellState is a cell in a world state, quantized as it is sent.
+type cellState struct {
+	cn, cell uint8
+	x, y     uint16 // position
+	dx, dy   uint16 // destination of the player
+	m        uint32 // mass
+}
+
+// snapshot is a world state, numbered so that clients can acknowledge it.
+// Clients only see the low 8 bits of seq.
+type snapshot struct {
+	seq   uint32
+	valid bool
+	cells []cellState // sorted by client number and cell
+}
+
+// takeSnapshot records the current world state in the snapshot history.
+func (g *Game) takeSnapshot() *snapshot {
+	s := &g.snapshots[g.seq%SNAPSHOT_HISTORY]
+	s.seq = g.seq
+	s.valid = true
+	s.cells = s.cells[:0]
+	g.seq++
+
+	m := g.m
+	for i := range g.players {
+		p := &g.players[i]
+		if !p.IsAlive {
+			continue
+		}
+		dx := uint16(p.D.X * (0xFFFF / m.W))
+		dy := uint16(p.D.Y * (0xFFFF / m.H))
+		for j := range p.Cells {
+			c := &p.Cells[j]
+			s.cells = append(s.cells, cellState{
+				cn:   uint8(i),
+				cell: uint8(j),
+				x:    uint16(c.O.X * (0xFFFF / m.W)),
+				y:    uint16(c.O.Y * (0xFFFF / m.H)),
+				dx:   dx,
+				dy:   dy,
+				m:    uint32(c.M),
+			})
+		}
+	}
+	return s
+}
+
+// ack records that a client received a snapshot, from the low 8 bits
+// of its number, which refer to the latest snapshot with those bits.
+// The caller must hold g.pLock.
+func (c *Client) ack(seq uint8) {
+	if c.g.seq == 0 {
+		return
+	}
+	latest := c.g.seq - 1
+	c.acked = int64(latest - uint32(uint8(latest)-seq))
+}
+
+// ackedSnapshot returns the last snapshot acknowledged by a client,
+// or nil if it is no longer in the history.
+func (g *Game) ackedSnapshot(c *Client) *snapshot {
+	if c.acked < 0 || int64(g.seq)-c.acked > SNAPSHOT_HISTORY {
+		return nil
+	}
+	s := &g.snapshots[c.acked%SNAPSHOT_HISTORY]
+	if !s.valid || int64(s.seq) != c.acked {
+		return nil
+	}
+	return s
+}
+
+// broadcastWorldState sends the world state to everyone.
+// Clients using delta encoding get the changes since the last world state
+// they acknowledged, and other clients get the whole world state.
+func (g *Game) broadcastWorldState() {
+	s := g.takeSnapshot()
+	full := buildWorldState(s)
+	pm := PrepareMessage(full)
+
+	// Clients that acknowledged the same snapshot get the same message
+	deltas := make(map[int]WSWriter)
+	for i := range g.players {
+		p := &g.players[i]
+		if !p.IsValid || p.Client == nil {
+			continue
+		}
+		c := p.Client
+		if !c.delta {
+			c.Send(pm)
+			continue
+		}
+
+		base := g.ackedSnapshot(c)
+		key := -1
+		if base != nil {
+			key = int(base.seq)
+		}
+		msg, ok := deltas[key]
+		if !ok {
+			msg = PrepareMessage(MsgWorldDelta(s, base))
+			deltas[key] = msg
+		}
+		c.Send(msg)
+	}
+
+	for c := range g.spectators {
+		c.Send(pm)
+	}
+	if g.rec != nil {
+		g.rec.record(full)
+	}
+}
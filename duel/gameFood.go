@@ -0,0 +1,187 @@
+package duel
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Food constants
+const (
+	// Maximum number of food pellets
+	MAX_FOOD = 512
+	// Minimum mass of a pellet
+	FOOD_MASS_MIN = 8
+	// Maximum mass of a pellet (must fit in a byte)
+	FOOD_MASS_MAX = 32
+	// Pellets spawned per second, until there are MAX_FOOD
+	FOOD_RESPAWN = 20
+	// Speed below which a moving pellet stops (per second)
+	FOOD_STOP_SPEED = 10.0
+)
+
+// Food is a pellet of mass that players consume on contact.
+type Food struct {
+	O       Vec2    // Origin
+	V       Vec2    // Velocity of an ejected pellet, per second
+	M       uint    // Mass
+	R       float64 // Radius
+	IsAlive bool
+}
+
+// addFood places a pellet in an unused slot.
+func (g *Game) addFood(id int, o Vec2, m uint) {
+	f := &g.food[id]
+	f.O = o
+	f.V = Vec2{}
+	f.M = m
+	f.R = math.Sqrt(float64(m))
+	f.IsAlive = true
+	g.foodAdded = append(g.foodAdded, id)
+}
+
+// freeFood returns an unused slot for a pellet, or -1 if there are none.
+func (g *Game) freeFood() int {
+	for i := range g.food {
+		if !g.food[i].IsAlive {
+			return i
+		}
+	}
+	return -1
+}
+
+// spawnFood places a random pellet in an unused slot, away from obstacles.
+func (g *Game) spawnFood(id int) {
+	m := FOOD_MASS_MIN + uint(rand.Intn(FOOD_MASS_MAX-FOOD_MASS_MIN+1))
+	g.addFood(id, g.m.pushOut(g.m.randomPoint(), math.Sqrt(float64(m))), m)
+}
+
+// fillFood spawns pellets in every unused slot.
+func (g *Game) fillFood() {
+	for i := range g.food {
+		if !g.food[i].IsAlive {
+			g.spawnFood(i)
+		}
+	}
+}
+
+// respawnFood spawns pellets at a rate of FOOD_RESPAWN per second.
+func (g *Game) respawnFood() {
+	g.foodRespawn += float64(FOOD_RESPAWN) / g.physFPS
+	for i := range g.food {
+		if g.foodRespawn < 1 {
+			return
+		}
+		if !g.food[i].IsAlive {
+			g.spawnFood(i)
+			g.foodRespawn--
+		}
+	}
+	// Do not save up pellets while full
+	g.foodRespawn = 0
+}
+
+// moveFood moves pellets that were ejected, slowing them down
+// like split cells, until they stop.
+func (g *Game) moveFood() {
+	for i := range g.food {
+		f := &g.food[i]
+		if !f.IsAlive || (f.V == Vec2{}) {
+			continue
+		}
+		f.O = g.m.pushOut(f.O.Add(f.V.Div(g.physFPS)), f.R)
+		f.V = f.V.Mul(g.splitDamping)
+		if f.V.LengthSquared() < FOOD_STOP_SPEED*FOOD_STOP_SPEED {
+			f.V = Vec2{}
+		}
+		g.markFoodMoved(i)
+	}
+}
+
+// markFoodMoved records that a pellet that clients may have seen moved.
+func (g *Game) markFoodMoved(id int) {
+	for _, moved := range g.foodMoved {
+		if moved == id {
+			return
+		}
+	}
+	for _, added := range g.foodAdded {
+		if added == id {
+			return
+		}
+	}
+	g.foodMoved = append(g.foodMoved, id)
+}
+
+// nearestFood returns the closest pellet within a distance, or nil if there are none.
+func (g *Game) nearestFood(o Vec2, dist float64) *Food {
+	var best *Food
+	bestDist2 := dist * dist
+	for i := range g.food {
+		f := &g.food[i]
+		if !f.IsAlive {
+			continue
+		}
+		if dist2 := o.Sub(f.O).LengthSquared(); dist2 < bestDist2 {
+			best = f
+			bestDist2 = dist2
+		}
+	}
+	return best
+}
+
+// eatFood lets the cells of a player consume every pellet whose center they cover.
+func (g *Game) eatFood(p *Player) {
+	for i := range g.food {
+		f := &g.food[i]
+		if !f.IsAlive {
+			continue
+		}
+		for j := range p.Cells {
+			c := &p.Cells[j]
+			diff := c.O.Sub(f.O)
+			if diff.X > c.R || diff.X < -c.R ||
+				diff.LengthSquared() > c.R*c.R {
+				continue
+			}
+
+			c.addMass(f.M)
+			f.IsAlive = false
+			g.removeFood(i)
+			break
+		}
+	}
+}
+
+// removeFood records that a pellet was removed.
+func (g *Game) removeFood(id int) {
+	for j, moved := range g.foodMoved {
+		if moved == id {
+			g.foodMoved = append(g.foodMoved[:j], g.foodMoved[j+1:]...)
+			break
+		}
+	}
+	// A pellet that clients have not seen yet does not need to be removed
+	for j, added := range g.foodAdded {
+		if added == id {
+			g.foodAdded = append(g.foodAdded[:j], g.foodAdded[j+1:]...)
+			return
+		}
+	}
+	g.foodEaten = append(g.foodEaten, id)
+}
+
+// broadcastFood sends the pellets removed, added and moved since the last call.
+func (g *Game) broadcastFood() {
+	if len(g.foodEaten) != 0 {
+		g.Broadcast(MsgFoodDel(g.foodEaten))
+		g.foodEaten = g.foodEaten[:0]
+	}
+	if len(g.foodAdded) != 0 {
+		g.Broadcast(MsgFoodAdd(g, g.foodAdded))
+		g.foodAdded = g.foodAdded[:0]
+	}
+	if len(g.foodMoved) != 0 {
+		g.Broadcast(MsgFoodAdd(g, g.foodMoved))
+		g.foodMoved = g.foodMoved[:0]
+	}
+}
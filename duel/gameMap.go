@@ -0,0 +1,257 @@
+package duel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// Map constants
+const (
+	// Maximum width or height of a map
+	MAP_SIZE_MAX = 10000
+	// Maximum number of obstacles or spawn zones in a map
+	MAP_ITEMS_MAX = 0xFF
+)
+
+// Rect is an axis-aligned rectangle, from its top-left corner.
+type Rect struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"w"`
+	H float64 `json:"h"`
+}
+
+// Obstacle is a static shape that players cannot pass through.
+// It is a circle around (X, Y) if R is set, and otherwise a Rect.
+type Obstacle struct {
+	Rect
+	R float64 `json:"r,omitempty"`
+}
+
+// Map describes the layout of an arena.
+// Maps are loaded from JSON files, for example:
+//
+//	{
+//		"name": "pillars",
+//		"width": 1600, "height": 900,
+//		"obstacles": [
+//			{"x": 400, "y": 450, "r": 80},
+//			{"x": 760, "y": 200, "w": 80, "h": 500}
+//		],
+//		"spawns": [
+//			{"x": 0, "y": 0, "w": 200, "h": 900},
+//			{"x": 1400, "y": 0, "w": 200, "h": 900}
+//		]
+//	}
+type Map struct {
+	Name string  `json:"name"`
+	W    float64 `json:"width"`
+	H    float64 `json:"height"`
+	// Players cannot pass through obstacles
+	Obstacles []Obstacle `json:"obstacles"`
+	// Players spawn only inside spawn zones, or anywhere if there are none
+	Spawns []Rect `json:"spawns"`
+}
+
+// DefaultMap returns an empty MAX_W by MAX_H map.
+func DefaultMap() *Map {
+	return &Map{
+		Name: "default",
+		W:    MAX_W,
+		H:    MAX_H,
+	}
+}
+
+// LoadMap reads a map from a JSON file.
+func LoadMap(path string) (*Map, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Map)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return m, nil
+}
+
+// LoadMaps reads every map in a directory with a .json extension.
+func LoadMaps(dir string) ([]*Map, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	maps := make([]*Map, 0, len(paths))
+	for _, path := range paths {
+		m, err := LoadMap(path)
+		if err != nil {
+			return nil, err
+		}
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
+
+// inside checks if a rectangle is inside a width by height area.
+func (r Rect) inside(w, h float64) bool {
+	return r.X >= 0 && r.Y >= 0 && r.W >= 0 && r.H >= 0 &&
+		r.X+r.W <= w && r.Y+r.H <= h
+}
+
+// Validate checks that the map is usable.
+func (m *Map) Validate() error {
+	if m.W <= 0 || m.H <= 0 || m.W > MAP_SIZE_MAX || m.H > MAP_SIZE_MAX {
+		return fmt.Errorf("width and height must be from 1 to %v", MAP_SIZE_MAX)
+	}
+	if len(m.Obstacles) > MAP_ITEMS_MAX || len(m.Spawns) > MAP_ITEMS_MAX {
+		return fmt.Errorf("maps can have at most %v obstacles and spawn zones", MAP_ITEMS_MAX)
+	}
+	for _, ob := range m.Obstacles {
+		if ob.R > 0 {
+			if !(Rect{ob.X - ob.R, ob.Y - ob.R, 2 * ob.R, 2 * ob.R}).inside(m.W, m.H) {
+				return errors.New("circular obstacles must be inside the map")
+			}
+		} else if !ob.Rect.inside(m.W, m.H) {
+			return errors.New("rectangular obstacles must be inside the map")
+		}
+	}
+	for _, sp := range m.Spawns {
+		if !sp.inside(m.W, m.H) || sp.W == 0 || sp.H == 0 {
+			return errors.New("spawn zones must be inside the map, and not empty")
+		}
+	}
+	return nil
+}
+
+// clampRange limits f so that a circle of radius r fits from 0 to max,
+// or centers it if it does not fit.
+func clampRange(f, r, max float64) float64 {
+	if 2*r >= max {
+		return max / 2
+	}
+	clamp(&f, r, max-r)
+	return f
+}
+
+// clamp returns the closest point inside the map.
+func (m *Map) clamp(v Vec2) Vec2 {
+	clamp(&v.X, 0, m.W)
+	clamp(&v.Y, 0, m.H)
+	return v
+}
+
+// pushOut returns the closest position of a circle of radius r to o,
+// that is inside the map and outside every obstacle.
+// Obstacles are resolved one at a time, so the result may still overlap
+// obstacles that are close together.
+func (m *Map) pushOut(o Vec2, r float64) Vec2 {
+	for i := range m.Obstacles {
+		ob := &m.Obstacles[i]
+		if ob.R > 0 {
+			center := Vec2{ob.X, ob.Y}
+			diff := o.Sub(center)
+			dist := ob.R + r
+			if diff.LengthSquared() >= dist*dist {
+				continue
+			}
+			if diff.LengthSquared() == 0 {
+				diff = randomDir()
+			}
+			o = center.Add(diff.Normalize().Mul(dist))
+			continue
+		}
+
+		// fast bounding box check
+		if o.X+r <= ob.X || o.X-r >= ob.X+ob.W ||
+			o.Y+r <= ob.Y || o.Y-r >= ob.Y+ob.H {
+			continue
+		}
+
+		closest := o
+		clamp(&closest.X, ob.X, ob.X+ob.W)
+		clamp(&closest.Y, ob.Y, ob.Y+ob.H)
+
+		if closest == o {
+			// inside: leave through the nearest edge
+			l, rt := o.X-ob.X, ob.X+ob.W-o.X
+			t, b := o.Y-ob.Y, ob.Y+ob.H-o.Y
+			switch math.Min(math.Min(l, rt), math.Min(t, b)) {
+			case l:
+				o.X = ob.X - r
+			case rt:
+				o.X = ob.X + ob.W + r
+			case t:
+				o.Y = ob.Y - r
+			default:
+				o.Y = ob.Y + ob.H + r
+			}
+		} else {
+			// outside: check if the circle is too far away
+			normal := o.Sub(closest)
+			if normal.LengthSquared() >= r*r {
+				continue
+			}
+			o = closest.Add(normal.Normalize().Mul(r))
+		}
+	}
+
+	o.X = clampRange(o.X, r, m.W)
+	o.Y = clampRange(o.Y, r, m.H)
+	return o
+}
+
+// blocked checks if a circle overlaps any obstacle.
+func (m *Map) blocked(o Vec2, r float64) bool {
+	for i := range m.Obstacles {
+		ob := &m.Obstacles[i]
+		if ob.R > 0 {
+			dist := ob.R + r
+			if o.Sub(Vec2{ob.X, ob.Y}).LengthSquared() < dist*dist {
+				return true
+			}
+			continue
+		}
+		closest := o
+		clamp(&closest.X, ob.X, ob.X+ob.W)
+		clamp(&closest.Y, ob.Y, ob.Y+ob.H)
+		if o.Sub(closest).LengthSquared() < r*r || closest == o {
+			return true
+		}
+	}
+	return false
+}
+
+// randomPoint returns a random point anywhere in the map.
+func (m *Map) randomPoint() Vec2 {
+	return Vec2{rand.Float64() * m.W, rand.Float64() * m.H}
+}
+
+// randomSpawn returns a random point in a spawn zone, picking zones by area.
+func (m *Map) randomSpawn() Vec2 {
+	if len(m.Spawns) == 0 {
+		return m.randomPoint()
+	}
+
+	total := 0.0
+	for _, sp := range m.Spawns {
+		total += sp.W * sp.H
+	}
+	pick := rand.Float64() * total
+	sp := m.Spawns[len(m.Spawns)-1]
+	for _, s := range m.Spawns {
+		if pick < s.W*s.H {
+			sp = s
+			break
+		}
+		pick -= s.W * s.H
+	}
+	return Vec2{sp.X + rand.Float64()*sp.W, sp.Y + rand.Float64()*sp.H}
+}
@@ -2,9 +2,12 @@ package duel
 
 import (
 	"math/rand"
+	"time"
+
+	"victorz.ca/gameserv/stats"
 )
 
-// Arena constants
+// Default arena constants
 const (
 	// Width
 	MAX_W = 1600.0
@@ -16,6 +19,8 @@ const (
 const (
 	// Movement speed (per second)
 	PL_SPEED = 200.0
+	// Distance of the destination ahead of a player with joystick input
+	PL_JOYSTICK_RANGE = 1000.0
 
 	// Starting size
 	PL_RAD_START  = 20
@@ -29,70 +34,69 @@ const (
 	PL_RAD_MAX  = 900
 	PL_MASS_MAX = PL_RAD_MAX * PL_RAD_MAX
 
-	// Decay (1/2^-x per frame)
+	// Decay (1/2^-x per DECAY_TIME)
 	PL_MASS_DECAY_SHIFT = 10
+	// Interval of mass decay
+	DECAY_TIME = 20 * time.Millisecond
 )
 
-/*
-	func clamp(f *float64, min, max float64) bool {
-		if *f < min {
-			*f = min
-			return true
-		} else if *f > max {
-			*f = max
-			return true
-		}
-		return false
+func clamp(f *float64, min, max float64) bool {
+	if *f < min {
+		*f = min
+		return true
+	} else if *f > max {
+		*f = max
+		return true
 	}
+	return false
+}
 
+/*
 	func clampAbs(f *float64, magnitude float64) bool {
 		return clamp(f, -magnitude, +magnitude)
 	}
 */
 
-func botThinkPlayer(g *Game, p *Player) {
-	if p.BotDivider == 0 {
-		p.BotDivider = 2 * PHYS_FPS
-	} else {
-		p.BotDivider--
-		return
+func movePlayer(g *Game, p *Player) {
+	if p.input == InputJoystick && !g.piloted(p) {
+		p.D = g.m.clamp(p.O.Add(p.Dir.Mul(PL_JOYSTICK_RANGE)))
 	}
-	best := p.D
-	bestDist2 := 1e200
-	for i := range g.players {
-		pp := &g.players[i]
-		if !pp.IsAlive || p == pp || pp.M > p.M {
-			continue
-		}
-		dist2 := p.O.Sub(pp.O).LengthSquared()
-		if bestDist2 > dist2 {
-			best = pp.O
-			bestDist2 = dist2
-		}
+	if d := p.D.Sub(p.O); d.LengthSquared() != 0 {
+		p.heading = d.Normalize()
 	}
-	p.D = best
-}
 
-func movePlayer(p *Player) {
-	diff := p.D.Sub(p.O)
-	moveDist := PL_SPEED / PHYS_FPS
-	if moveDist*moveDist < diff.LengthSquared() {
-		diff = diff.Normalize().Mul(moveDist)
+	moveDist := PL_SPEED / g.physFPS * p.Speed
+	if g.frame < p.boostEnd {
+		moveDist *= STREAK_SPEED_BOOST
 	}
+	for i := range p.Cells {
+		c := &p.Cells[i]
+		diff := p.D.Sub(c.O)
+		if moveDist*moveDist < diff.LengthSquared() {
+			diff = diff.Normalize().Mul(moveDist)
+		}
 
-	p.O = p.O.Add(diff)
+		c.O = g.m.pushOut(c.O.Add(diff).Add(c.V.Div(g.physFPS)), c.R)
+		c.V = c.V.Mul(g.splitDamping)
+	}
 }
 
-func decayPlayer(p *Player) {
-	decayMass := p.M >> PL_MASS_DECAY_SHIFT
-	newMass := p.M - decayMass
-	if newMass < PL_MASS_MIN {
-		newMass = PL_MASS_MIN
+// decayPlayer shrinks the cells of a player by the given number of decay steps.
+func decayPlayer(p *Player, steps int) {
+	for i := range p.Cells {
+		c := &p.Cells[i]
+		newMass := c.M
+		for k := 0; k < steps; k++ {
+			newMass -= newMass >> PL_MASS_DECAY_SHIFT
+		}
+		if newMass < PL_MASS_MIN {
+			newMass = PL_MASS_MIN
+		}
+		c.setMass(newMass)
 	}
-	p.setMass(newMass)
 }
 
-func collide(a, b *Player) bool {
+func collide(a, b *Cell) bool {
 	diff := a.O.Sub(b.O)
 	dist := a.R + b.R
 	return diff.X <= dist &&
@@ -100,13 +104,31 @@ func collide(a, b *Player) bool {
 		diff.LengthSquared() <= dist*dist
 }
 
-func (g *Game) checkCollision(a, b *Player, aCn, bCn int) {
-	if !collide(a, b) {
-		return
-	}
+// CollisionMode is how an arena decides which of two colliding cells absorbs the other.
+type CollisionMode uint8
 
+// Collision modes
+const (
+	// A random cell wins, weighted by mass, and remote players are favoured over bots.
+	CollideRandom CollisionMode = iota
+	// The larger cell wins once it covers enough of the smaller cell.
+	CollideMass
+)
+
+// Causes of death, sent in MsgDeath
+const (
+	// Lost a random roll. The detail is the chance the victim had of winning, out of 255.
+	DEATH_ROLL = 0
+	// Covered by a larger cell. The detail is the mass of the killer's cell
+	// in sixteenths of the mass of the victim's cell, up to 255.
+	DEATH_MASS = 1
+)
+
+// resolveRandom picks the winner of two colliding cells at random.
+// It returns the winner (1 for a, 2 for b), and the chance the loser had of winning.
+func resolveRandom(a, b *Player, ac, bc *Cell) (winner int, detail byte) {
 	// Calculate probability that Player A wins
-	p := 0.1 + float64(a.M)/float64(a.M+b.M)*0.8
+	p := 0.1 + float64(ac.M)/float64(ac.M+bc.M)*0.8
 	aIsBot := a.Client == nil
 	bIsBot := b.Client == nil
 	if aIsBot != bIsBot {
@@ -115,69 +137,190 @@ func (g *Game) checkCollision(a, b *Player, aCn, bCn int) {
 			p += 0.9
 		}
 	}
-	if rand.Float64() >= p {
-		// Player B wins
-		a, b = b, a
-		aCn, bCn = bCn, aCn
+
+	if rand.Float64() < p {
+		return 1, byte((1 - p) * 0xFF)
+	}
+	return 2, byte(p * 0xFF)
+}
+
+// resolveMass picks the larger of two colliding cells as the winner,
+// if it covers at least a fraction of the diameter of the smaller cell.
+// It returns the winner (1 for a, 2 for b, or 0 for neither), and the mass ratio.
+func resolveMass(ac, bc *Cell, cover float64) (winner int, detail byte) {
+	winner = 1
+	if ac.M < bc.M {
+		winner = 2
+		ac, bc = bc, ac
+	} else if ac.M == bc.M {
+		return 0, 0
+	}
+
+	dist := ac.R + bc.R*(1-2*cover)
+	if ac.O.Sub(bc.O).LengthSquared() > dist*dist {
+		return 0, 0
+	}
+
+	ratio := ac.M * 16 / bc.M
+	if ratio > 0xFF {
+		ratio = 0xFF
+	}
+	return winner, byte(ratio)
+}
+
+// checkCollision lets overlapping cells of two players absorb each other.
+func (g *Game) checkCollision(a, b *Player, aCn, bCn int) {
+	changed := false
+	for i := 0; i < len(a.Cells); i++ {
+		for j := 0; j < len(b.Cells); j++ {
+			ac, bc := &a.Cells[i], &b.Cells[j]
+			if !collide(ac, bc) {
+				continue
+			}
+
+			var winner int
+			var reason, detail byte
+			switch g.collision {
+			case CollideMass:
+				reason = DEATH_MASS
+				winner, detail = resolveMass(ac, bc, g.cover)
+			default:
+				reason = DEATH_ROLL
+				winner, detail = resolveRandom(a, b, ac, bc)
+			}
+
+			if winner == 1 {
+				changed = true
+				ac.addMass(bc.M)
+				a.Score += bc.M
+				b.removeCell(j)
+				j--
+				if len(b.Cells) == 0 {
+					g.killPlayer(a, b, aCn, bCn, reason, detail)
+					break
+				}
+			} else if winner == 2 {
+				changed = true
+				bc.addMass(ac.M)
+				b.Score += ac.M
+				a.removeCell(i)
+				i--
+				if len(a.Cells) == 0 {
+					g.killPlayer(b, a, bCn, aCn, reason, detail)
+				}
+				break
+			}
+		}
+		if !b.IsAlive {
+			break
+		}
+	}
+
+	if changed {
+		a.updateCells()
+		b.updateCells()
 	}
+}
 
-	// 75% of mass is transferable
-	newMass := a.M + b.M // - (b.M >> 1)
-	// check against maximum and for overflow
-	if newMass > PL_MASS_MAX || newMass < a.M {
-		newMass = PL_MASS_MAX
+// killPlayer records that a player absorbed the last cell of another.
+func (g *Game) killPlayer(a, b *Player, aCn, bCn int, reason, detail byte) {
+	var flags byte
+	if a.lastKiller == bCn {
+		flags |= DEATH_FLAG_REVENGE
+		a.lastKiller = -1
 	}
-	a.setMass(newMass)
+	b.lastKiller = aCn
 
 	a.Kills++
 	a.Combo++
 	b.Deaths++
 	b.Combo = 0
+	b.boostEnd = 0
 	b.IsAlive = false
-	g.Broadcast(MsgDeath(aCn, bCn))
+	g.eliminate(b, bCn)
+	g.Broadcast(MsgDeath(aCn, bCn, reason, detail, flags))
+	g.checkStreak(a, aCn)
+
+	g.recordStats(a, stats.Stats{DuelKills: 1, DuelBestCombo: a.Combo})
+	g.recordStats(b, stats.Stats{DuelDeaths: 1})
+	g.recordPeak(b)
 }
 
 func (g *Game) spawnPlayer(p *Player) {
+	var o Vec2
 BRUTE_FORCE_SPAWN_POS:
 	for i := 0; i < 256; i++ {
-		p.O.X = rand.Float64() * MAX_W
-		p.O.Y = rand.Float64() * MAX_H
+		o = g.m.randomSpawn()
+		if g.m.blocked(o, PL_RAD_START) {
+			continue
+		}
 
 		for j := range g.players {
 			pp := &g.players[j]
-			if collide(p, pp) {
+			if pp.IsAlive && pp.overlaps(o, PL_RAD_START) {
 				continue BRUTE_FORCE_SPAWN_POS
 			}
 		}
 		break
 	}
 
-	p.D.X = p.O.X
-	p.D.Y = p.O.Y
-	p.M = PL_MASS_START
-	p.R = PL_RAD_START
+	p.Cells = append(p.Cells[:0], Cell{
+		O: o,
+		M: PL_MASS_START,
+		R: PL_RAD_START,
+	})
+	p.updateCells()
+	p.D = p.O
+	p.heading = randomDir()
 	p.IsAlive = true
-	p.BotDivider = 0
+	p.bot.divider = 0
+	p.bot.behaviour = botWander
 }
 
-// PhysicsFrame applies physics by moving all objects for a time increment of PHYS_TIME.
+// PhysicsFrame applies physics by moving all objects for the time of one frame.
 func (g *Game) PhysicsFrame() {
+	g.frame++
+	g.respawnFood()
+	g.moveFood()
+	if g.royale {
+		g.shrinkZone()
+	}
+
+	decaySteps := g.decaySteps()
 	for i := range g.players {
 		p := &g.players[i]
-		if !p.IsValid {
+		if !p.IsValid || g.parked(p) {
 			continue
 		} else if p.IsAlive {
-			if p.Client == nil {
+			if g.piloted(p) {
 				botThinkPlayer(g, p)
 			}
-			movePlayer(p)
-			decayPlayer(p)
+			g.useAbilities(p)
+			movePlayer(g, p)
+			g.mergeCells(p)
+			decayPlayer(p, decaySteps)
+			if g.royale && !g.zoneDecayPlayer(p, decaySteps) {
+				p.Deaths++
+				p.Combo = 0
+				p.boostEnd = 0
+				p.IsAlive = false
+				g.eliminate(p, i)
+				g.Broadcast(MsgDeath(i, i, DEATH_ZONE, 0, 0))
+				g.recordStats(p, stats.Stats{DuelDeaths: 1})
+				g.recordPeak(p)
+				continue
+			}
+			g.eatFood(p)
+			p.updateCells()
+			if p.M > p.peakMass {
+				p.peakMass = p.M
+			}
 
 			// check only against higher players,
 			// to avoid double-checking
 			for j := i + 1; j < len(g.players); j++ {
 				b := &g.players[j]
-				if !b.IsAlive {
+				if !b.IsAlive || sameTeam(p, b) || g.parked(b) {
 					continue
 				}
 				g.checkCollision(p, b, i, j)
@@ -186,7 +329,7 @@ func (g *Game) PhysicsFrame() {
 					break
 				}
 			}
-		} else {
+		} else if !p.IsOut {
 			// TODO use spawn queue
 			// force spawn
 			g.spawnPlayer(p)
@@ -5,30 +5,64 @@ import (
 	"math"
 	"math/rand"
 	"sync"
+	"time"
 )
 
+// Cell is a piece of a Player. Players have one cell, until they split.
+type Cell struct {
+	O Vec2    // Origin
+	V Vec2    // Velocity after splitting
+	M uint    // Mass
+	R float64 // Radius (sqrt(mass))
+
+	mergeFrame uint64 // frame after which the cell may merge
+}
+
 // Player represents a player, either a remotely-connected client or a local bot.
 type Player struct {
 	// Inputs
 	Name  string
-	Color uint8
-	D     Vec2 // Destination
-
-	// Game State
-	O Vec2    // Origin
-	M uint    // Mass
-	R float64 // Radius (cuberoot(mass))
+	ID    string  // account name, or blank for bots and anonymous players
+	Color int     // 24-bit RGB
+	Skin  uint8   // 1 to len(skins), or 0 without a skin
+	Team  uint8   // 1 to MAX_TEAMS, or 0 without teams
+	D     Vec2    // Destination
+	Dir   Vec2    // Direction, with joystick input
+	Speed float64 // Fraction of full speed, from 0 to 1
 
-	Kills   uint
-	Deaths  uint
-	Combo   uint
-	IsAlive bool
+	input InputMode
 
-	Score uint
+	// Game State
+	Cells []Cell
+	O     Vec2    // Center of mass of all cells
+	M     uint    // Total mass of all cells
+	R     float64 // Radius of a cell with the total mass
+
+	heading   Vec2   // last direction of movement
+	wantSplit bool   // split on the next frame
+	wantEject bool   // eject mass on the next frame
+	nextSplit uint64 // frame when split is ready
+	nextEject uint64 // frame when eject is ready
+	boostEnd  uint64 // frame when a speed boost ends
+
+	Kills      uint
+	Deaths     uint
+	Combo      uint
+	lastKiller int // client number of the last player to kill this one, or -1
+	IsAlive    bool
+	IsOut      bool // eliminated from a battle royale
+
+	Score    uint // mass absorbed from other players
+	peakMass uint // largest mass since spawning
 
 	IsValid bool
 	*Client
-	BotDivider uint
+	bot botState
+
+	// ResumeToken lets the client resume control after disconnecting
+	ResumeToken   string
+	Detached      bool // disconnected, and waiting to resume
+	detachedSince time.Time
 
 	sync.Mutex
 }
@@ -40,46 +74,62 @@ func (p *Player) Reset() {
 	p.Client = nil
 	p.IsValid = false
 	p.IsAlive = false
+	p.Cells = p.Cells[:0]
 }
 
 func (p *Player) init() {
+	if p.Cells == nil {
+		p.Cells = make([]Cell, 0, PL_CELLS_MAX)
+	}
+	p.Cells = p.Cells[:0]
+	p.Team = 0
+	p.IsOut = false
+	p.wantSplit = false
+	p.wantEject = false
 	p.Kills = 0
 	p.Deaths = 0
+	p.lastKiller = -1
+	p.peakMass = 0
+	p.ResumeToken = ""
+	p.Detached = false
+	p.input = InputMouse
+	p.Dir = Vec2{}
+	p.Speed = 1
+	p.boostEnd = 0
 	p.IsAlive = false
 	p.IsValid = true
 	p.Score = 0
 }
 
 // InitPlayer initializes a remote-controlled Player.
-func (p *Player) InitPlayer(name []byte, col uint8) {
+func (p *Player) InitPlayer(name []byte, id string, col int, skin uint8) {
 	p.init()
 	p.Name = filterName(name)
-	p.Color = col
+	p.ID = id
+	p.Color = filterColor(col)
+	p.Skin = skin
 }
 
-// InitBot initializes a bot-controlled Player.
-func (p *Player) InitBot() {
+// InitBot initializes a bot-controlled Player with the given name.
+func (p *Player) InitBot(name string) {
 	p.init()
-	p.Name = "" // randomName()
-	p.Color = uint8(rand.Intn(0x100))
+	p.Name = name
+	p.ID = ""
+	p.Color = rand.Intn(0x1000000)
+	p.Skin = 0
+	p.bot = botState{
+		BotPersonality: &botPersonalities[rand.Intn(len(botPersonalities))],
+	}
 }
 
-/*
-// randomName generates a random player name.
-func randomName() string {
-	var b [4]byte
-	rand.Read(b[:])
-	return hex.EncodeToString(b[:])
-}
-*/
+// Maximum length of a name
+const MAX_NAME_LEN = 16
 
 // filterName sanitizes a name.
 // Invalid characters are removed.
 // Names are truncated if they are too long.
 // If a name would be blank, a valid name will be returned instead.
 func filterName(name []byte) string {
-	const MAX_NAME_LEN = 16
-
 	name = bytes.Map(func(r rune) rune {
 		switch {
 		case (r >= '0' && r <= '9'),
@@ -107,9 +157,74 @@ func filterName(name []byte) string {
 	return s
 }
 
-func (p *Player) setMass(m uint) {
+// filterColor sanitizes a color value.
+func filterColor(c int) int {
+	return c & 0xFFFFFF
+}
+
+// paletteColor converts a color from the 8-bit RGB palette
+// (3 bits red, 3 bits green, 2 bits blue) to a 24-bit color.
+func paletteColor(c uint8) int {
+	r := int(c>>5) * 0xFF / 7
+	g := int(c>>2&7) * 0xFF / 7
+	b := int(c&3) * 0xFF / 3
+	return r<<16 | g<<8 | b
+}
+
+// colorPalette converts a 24-bit color to the nearest lower color
+// in the 8-bit RGB palette, so that palette colors convert back exactly.
+func colorPalette(c int) uint8 {
+	return uint8(c>>16&0xE0 | c>>11&0x1C | c>>6&0x03)
+}
+
+func (c *Cell) setMass(m uint) {
+	if c.M != m {
+		c.M = m
+		c.R = math.Sqrt(float64(m))
+	}
+}
+
+// addMass increases the mass of a cell, up to PL_MASS_MAX.
+func (c *Cell) addMass(m uint) {
+	newMass := c.M + m
+	// check against maximum and for overflow
+	if newMass > PL_MASS_MAX || newMass < c.M {
+		newMass = PL_MASS_MAX
+	}
+	c.setMass(newMass)
+}
+
+// removeCell removes a cell from a player.
+func (p *Player) removeCell(i int) {
+	p.Cells = append(p.Cells[:i], p.Cells[i+1:]...)
+}
+
+// updateCells updates the total mass, center of mass, and radius of a player.
+func (p *Player) updateCells() {
+	var m uint
+	var o Vec2
+	for i := range p.Cells {
+		c := &p.Cells[i]
+		m += c.M
+		o = o.Add(c.O.Mul(float64(c.M)))
+	}
+	if m != 0 {
+		p.O = o.Div(float64(m))
+	}
 	if p.M != m {
 		p.M = m
 		p.R = math.Sqrt(float64(m))
 	}
 }
+
+// overlaps checks if any cell of a player overlaps a circle.
+func (p *Player) overlaps(o Vec2, r float64) bool {
+	for i := range p.Cells {
+		c := &p.Cells[i]
+		dist := c.R + r
+		if c.O.Sub(o).LengthSquared() <= dist*dist {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package duel
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Replay constants
+const (
+	// Extension of replay files
+	REPLAY_EXT = ".duel.gz"
+	// Number of messages queued for writing before messages are dropped
+	REPLAY_QUEUE = 1024
+	// Fastest replay speed
+	REPLAY_SPEED_MAX = 16
+	// Longest recording in one replay file, before a new file is started
+	REPLAY_MAX_TIME = 1 * time.Hour
+	// Interval at which replay files are flushed, so they can be watched while recording
+	REPLAY_FLUSH_TIME = 10 * time.Second
+)
+
+// A recorder writes every message broadcast in an arena to a replay file.
+// Replay files are gzip-compressed, and contain one entry per message:
+// the milliseconds since the recording started (uint32),
+// the length of the message (uint32), and the message.
+// A new file is started for each round, and after REPLAY_MAX_TIME.
+type recorder struct {
+	start   time.Time
+	msgs    chan []byte
+	done    chan struct{}
+	dropped int
+}
+
+// startRecording creates a replay file in dir, and records the current state
+// of the arena as a spectator would receive it.
+func (g *Game) startRecording(dir string) {
+	name := g.name + "-" + time.Now().UTC().Format("20060102-150405") + REPLAY_EXT
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		log.Printf("*%v cannot record: %v\n", g.name, err)
+		return
+	}
+	log.Printf(" %v recording to %v\n", g.name, name)
+
+	rec := &recorder{
+		start: time.Now(),
+		msgs:  make(chan []byte, REPLAY_QUEUE),
+		done:  make(chan struct{}),
+	}
+	go rec.write(f)
+
+	g.rec = rec
+	rec.record(MsgSpectate())
+	g.sendState(rec.record, -1, true)
+}
+
+// stopRecording stops recording to the replay file.
+// The file is finished by finishRecordings.
+func (g *Game) stopRecording() {
+	if g.rec == nil {
+		return
+	}
+	close(g.rec.msgs)
+	g.finishing = append(g.finishing, g.rec)
+	g.rec = nil
+}
+
+// finishRecordings waits for stopped replay files to be written.
+// The caller must not hold g.pLock,
+// so that players can join and leave while the files are written.
+func (g *Game) finishRecordings() {
+	g.pLock.Lock()
+	finishing := g.finishing
+	g.finishing = nil
+	g.pLock.Unlock()
+
+	for _, rec := range finishing {
+		<-rec.done
+		if rec.dropped != 0 {
+			log.Printf("*%v replay dropped %v messages\n", g.name, rec.dropped)
+		}
+	}
+}
+
+// rotateRecording finishes the replay file and starts a new one, if recording.
+func (g *Game) rotateRecording() {
+	if g.rec == nil {
+		return
+	}
+	g.stopRecording()
+	g.startRecording(g.replayDir)
+}
+
+// record queues a message to be written, or drops it if the queue is full.
+func (rec *recorder) record(msg []byte) {
+	e := make([]byte, 8+len(msg))
+	binary.BigEndian.PutUint32(e, uint32(time.Since(rec.start)/time.Millisecond))
+	binary.BigEndian.PutUint32(e[4:], uint32(len(msg)))
+	copy(e[8:], msg)
+
+	select {
+	case rec.msgs <- e:
+	default:
+		rec.dropped++
+	}
+}
+
+// write writes queued messages until the queue is closed,
+// and flushes the file every REPLAY_FLUSH_TIME.
+func (rec *recorder) write(f *os.File) {
+	defer close(rec.done)
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	zw := gzip.NewWriter(bw)
+	flush := time.NewTicker(REPLAY_FLUSH_TIME)
+	defer flush.Stop()
+
+	var err error
+	for err == nil {
+		select {
+		case e, ok := <-rec.msgs:
+			if !ok {
+				if err = zw.Close(); err == nil {
+					err = bw.Flush()
+				}
+				if err != nil {
+					log.Printf("*replay %v: %v\n", f.Name(), err)
+				}
+				return
+			}
+			_, err = zw.Write(e)
+		case <-flush.C:
+			if err = zw.Flush(); err == nil {
+				err = bw.Flush()
+			}
+		}
+	}
+
+	log.Printf("*replay %v: %v\n", f.Name(), err)
+	for range rec.msgs {
+	}
+}
+
+// replayEntry is a message read from a replay file.
+type replayEntry struct {
+	t   time.Duration // time since the recording started
+	msg []byte
+}
+
+// A replayReader reads the messages of a replay file in order.
+type replayReader struct {
+	f  *os.File
+	zr *gzip.Reader
+}
+
+// openReplay opens a replay file by name in dir.
+// Names are checked, so that only replay files in dir can be opened.
+func openReplay(dir, name string) (*replayReader, error) {
+	if name != filepath.Base(name) || !strings.HasSuffix(name, REPLAY_EXT) {
+		return nil, os.ErrNotExist
+	}
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &replayReader{f, zr}, nil
+}
+
+// next reads the next message, or returns io.EOF at the end of the replay.
+// A file that is still being recorded ends after its last flushed message.
+func (rr *replayReader) next() (replayEntry, error) {
+	var h [8]byte
+	if n, err := io.ReadFull(rr.zr, h[:]); err != nil {
+		if n == 0 && err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return replayEntry{}, err
+	}
+	e := replayEntry{
+		t:   time.Duration(binary.BigEndian.Uint32(h[:])) * time.Millisecond,
+		msg: make([]byte, binary.BigEndian.Uint32(h[4:])),
+	}
+	if _, err := io.ReadFull(rr.zr, e.msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return replayEntry{}, err
+	}
+	return e, nil
+}
+
+// Close closes the replay file.
+func (rr *replayReader) Close() error {
+	rr.zr.Close()
+	return rr.f.Close()
+}
+
+// listReplays returns the names of the replay files in dir.
+func listReplays(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+REPLAY_EXT))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return names, nil
+}
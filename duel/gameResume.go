@@ -0,0 +1,107 @@
+package duel
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"time"
+)
+
+// Resume constants
+const (
+	// Default time that the slot of a disconnected player is kept
+	RESUME_GRACE = 30 * time.Second
+	// Longest time that the slot of a disconnected player may be kept
+	MAX_RESUME_GRACE = 10 * time.Minute
+	// Length of resume tokens, in bytes before hex encoding
+	RESUME_TOKEN_LEN = 16
+)
+
+// newResumeToken returns a random resume token.
+func newResumeToken() string {
+	b := make([]byte, RESUME_TOKEN_LEN)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// piloted checks if a player is controlled by the server:
+// bots, and disconnected players if the arena lets bots pilot them.
+func (g *Game) piloted(p *Player) bool {
+	return p.Client == nil || (p.Detached && g.resumePilot)
+}
+
+// parked checks if a player is disconnected and not piloted by a bot.
+// Parked players are frozen, so they neither move, decay, eat nor get eaten
+// until they resume.
+func (g *Game) parked(p *Player) bool {
+	return p.Detached && !g.resumePilot
+}
+
+// detachPlayer keeps the slot of a player whose client disconnected,
+// so that it may resume with its token. Without a grace period,
+// the player is removed instead.
+func (g *Game) detachPlayer(c *Client, cn int) {
+	if g.resumeGrace == 0 {
+		g.DelPlayer(cn)
+		return
+	}
+
+	g.pLock.Lock()
+	defer g.pLock.Unlock()
+
+	p := &g.players[cn]
+	if !p.IsValid || p.Client != c {
+		return
+	}
+	p.Detached = true
+	p.detachedSince = time.Now()
+	if g.resumePilot {
+		p.bot = botState{
+			BotPersonality: &botPersonalities[0],
+			behaviour:      botWander,
+		}
+		p.Speed = 1
+	}
+}
+
+// expireDetached removes disconnected players who did not resume in time.
+// The caller must hold g.pLock.
+func (g *Game) expireDetached(now time.Time) {
+	for i := range g.players {
+		p := &g.players[i]
+		if p.IsValid && p.Detached && now.Sub(p.detachedSince) > g.resumeGrace {
+			g.delPlayer(i)
+		}
+	}
+}
+
+// ResumePlayer gives control of a disconnected player back to a new client
+// with its resume token, and returns the Client, or nil if there is no such player.
+func (g *Game) ResumePlayer(token string) *Client {
+	g.pLock.Lock()
+	defer g.pLock.Unlock()
+
+	for i := range g.players {
+		p := &g.players[i]
+		if !p.IsValid || !p.Detached ||
+			subtle.ConstantTimeCompare([]byte(p.ResumeToken), []byte(token)) != 1 {
+			continue
+		}
+
+		old := p.Client
+		p.Client = newClient(g, i)
+		p.Client.rgb = true // resuming takes a JSON hello
+		p.Client.delta = old.delta
+		p.Detached = false
+		p.D = p.O
+		p.Speed = 0
+
+		p.Client.SendB(MsgWelcome(i, p.input))
+		p.Client.SendB(MsgResumeToken(p.ResumeToken))
+		g.sendState(p.Client.SendB, -1, true)
+		return p.Client
+	}
+	return nil
+}
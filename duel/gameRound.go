@@ -0,0 +1,143 @@
+package duel
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Round constants
+const (
+	// Time between the end of a round and the start of the next
+	ROUND_PAUSE = 5 * time.Second
+	// Interval of countdown updates
+	ROUND_COUNTDOWN_TIME = 1 * time.Second
+	// Number of players announced at the end of a round
+	ROUND_TOP = 3
+)
+
+// RoundWinMode is how the winner of a round is chosen.
+type RoundWinMode uint8
+
+// Round win modes
+const (
+	// The player with the highest score wins.
+	WinByScore RoundWinMode = iota
+	// The living player with the most mass wins.
+	WinByMass
+	// The last player left in a battle royale wins.
+	WinBySurvival
+)
+
+// Round phases, sent in MsgRound
+const (
+	// A new round started, and all scores were reset
+	ROUND_START = 0
+	// The round is being played
+	ROUND_PLAYING = 1
+	// The round ended, and the next round starts soon
+	ROUND_PAUSED = 2
+)
+
+// paused checks if the arena is between rounds.
+func (g *Game) paused() bool {
+	return !g.pauseEnd.IsZero()
+}
+
+// roundState returns a message with the phase of the round and the time remaining.
+func (g *Game) roundState(now time.Time) []byte {
+	if g.paused() {
+		return MsgRound(ROUND_PAUSED, g.pauseEnd.Sub(now))
+	}
+	return MsgRound(ROUND_PLAYING, g.roundEnd.Sub(now))
+}
+
+// updateRound ends rounds, starts new rounds, and broadcasts the countdown.
+func (g *Game) updateRound(now time.Time) {
+	switch {
+	case g.paused():
+		if now.After(g.pauseEnd) {
+			g.resetArena()
+			g.rotateRecording()
+			g.pauseEnd = time.Time{}
+			g.roundEnd = now.Add(g.roundTime)
+			g.nextCountdown = now.Add(ROUND_COUNTDOWN_TIME)
+			g.Broadcast(MsgRound(ROUND_START, g.roundTime))
+		}
+	case now.After(g.roundEnd):
+		g.Broadcast(MsgRoundEnd(g.roundWin, g.ranking()))
+		g.pauseEnd = now.Add(ROUND_PAUSE)
+		g.Broadcast(g.roundState(now))
+	case now.After(g.nextCountdown):
+		g.Broadcast(g.roundState(now))
+		g.nextCountdown = now.Add(ROUND_COUNTDOWN_TIME)
+	}
+}
+
+// rank is the result of a player in a round.
+type rank struct {
+	cn    int
+	value uint // score or mass
+}
+
+// ranking returns the best players of the round, best first.
+func (g *Game) ranking() []rank {
+	var ranks []rank
+	for i := range g.players {
+		p := &g.players[i]
+		if !p.IsValid {
+			continue
+		}
+		r := rank{cn: i}
+		switch g.roundWin {
+		case WinByMass:
+			if p.IsAlive {
+				r.value = p.M
+			}
+		default:
+			r.value = p.Score
+		}
+		ranks = append(ranks, r)
+	}
+
+	sort.SliceStable(ranks, func(i, j int) bool {
+		return ranks[i].value > ranks[j].value
+	})
+	if len(ranks) > ROUND_TOP {
+		ranks = ranks[:ROUND_TOP]
+	}
+	return ranks
+}
+
+// resetArena resets the mass, kills, deaths, combo and score of every player,
+// who respawn on the next frame. If the arena has several maps, a new one is picked.
+func (g *Game) resetArena() {
+	for i := range g.players {
+		p := &g.players[i]
+		if !p.IsValid {
+			continue
+		}
+		p.Kills = 0
+		p.Deaths = 0
+		p.Combo = 0
+		p.Score = 0
+		p.IsAlive = false
+		p.Cells = p.Cells[:0]
+	}
+
+	if len(g.maps) > 1 {
+		g.m = g.maps[rand.Intn(len(g.maps))]
+		g.Broadcast(MsgMap(g.m))
+
+		// Move pellets out of the new obstacles
+		for i := range g.food {
+			g.food[i].IsAlive = false
+		}
+		g.foodAdded = g.foodAdded[:0]
+		g.foodEaten = g.foodEaten[:0]
+		g.foodMoved = g.foodMoved[:0]
+		g.fillFood()
+		g.foodAdded = g.foodAdded[:0]
+		g.Broadcast(MsgFoodSnapshot(g))
+	}
+}
@@ -0,0 +1,183 @@
+package duel
+
+import (
+	"math"
+	"time"
+)
+
+// Battle royale constants
+const (
+	// Time before the zone starts shrinking
+	ROYALE_GRACE_TIME = 20 * time.Second
+	// Time for the zone to shrink to its smallest size
+	ROYALE_SHRINK_TIME = 3 * time.Minute
+	// Smallest radius of the zone
+	ROYALE_RAD_MIN = 60.0
+	// Decay outside the zone (1/2^-x per DECAY_TIME)
+	ROYALE_DECAY_SHIFT = 6
+)
+
+// Causes of death, sent in MsgDeath
+const (
+	// Shrunk to nothing outside the zone. The killer is the victim.
+	DEATH_ZONE = 2
+)
+
+// royaleZone is the playable region of a battle royale,
+// which shrinks from the whole map towards a random point.
+type royaleZone struct {
+	start, end Vec2    // centers
+	r0         float64 // starting radius
+	frame      uint64  // frames since the royale started
+
+	O Vec2    // current center
+	R float64 // current radius
+}
+
+// resetZone makes the zone cover the whole map again, and picks a new end point.
+func (g *Game) resetZone() {
+	z := &g.zone
+	z.start = Vec2{g.m.W / 2, g.m.H / 2}
+	z.r0 = z.start.Length()
+	end := g.m.randomPoint()
+	z.end.X = clampRange(end.X, ROYALE_RAD_MIN, g.m.W)
+	z.end.Y = clampRange(end.Y, ROYALE_RAD_MIN, g.m.H)
+	z.frame = 0
+	z.O = z.start
+	z.R = z.r0
+}
+
+// shrinkZone moves the zone by one frame.
+func (g *Game) shrinkZone() {
+	z := &g.zone
+	z.frame++
+	elapsed := time.Duration(z.frame) * g.physTime
+	if elapsed <= ROYALE_GRACE_TIME {
+		return
+	}
+	t := math.Min(float64(elapsed-ROYALE_GRACE_TIME)/float64(ROYALE_SHRINK_TIME), 1)
+	z.O = z.start.Add(z.end.Sub(z.start).Mul(t))
+	z.R = z.r0 + (ROYALE_RAD_MIN-z.r0)*t
+}
+
+// inZone checks if a point is inside the zone.
+func (g *Game) inZone(o Vec2) bool {
+	return o.Sub(g.zone.O).LengthSquared() <= g.zone.R*g.zone.R
+}
+
+// zoneDecayPlayer drains the cells of a player that are outside the zone
+// by the given number of decay steps, and removes cells that are already
+// at the minimum mass. It returns false if the player lost its last cell.
+func (g *Game) zoneDecayPlayer(p *Player, steps int) bool {
+	if steps == 0 {
+		return true
+	}
+	for i := 0; i < len(p.Cells); i++ {
+		c := &p.Cells[i]
+		if g.inZone(c.O) {
+			continue
+		}
+		if c.M <= PL_MASS_MIN {
+			p.removeCell(i)
+			i--
+			continue
+		}
+		newMass := c.M
+		for k := 0; k < steps && newMass > PL_MASS_MIN; k++ {
+			newMass -= newMass>>ROYALE_DECAY_SHIFT + 1
+		}
+		if newMass < PL_MASS_MIN {
+			newMass = PL_MASS_MIN
+		}
+		c.setMass(newMass)
+	}
+	return len(p.Cells) != 0
+}
+
+// joinRoyale lets a new player take part in the battle royale if it has not
+// really started (with fewer than two players). Otherwise, the player waits
+// for the next one.
+func (g *Game) joinRoyale(p *Player) {
+	if !g.royale {
+		return
+	}
+	if g.royaleCount >= 2 {
+		p.IsOut = true
+	} else {
+		g.royaleCount++
+	}
+}
+
+// eliminate records that a player is out of the battle royale.
+// Until two players take part, players respawn instead.
+func (g *Game) eliminate(p *Player, cn int) {
+	if g.royale && g.royaleCount >= 2 {
+		p.IsOut = true
+		g.royaleOut = append(g.royaleOut, cn)
+	}
+}
+
+// leaveRoyale records that a player left the arena. If it was still taking
+// part in the battle royale, it no longer counts.
+func (g *Game) leaveRoyale(p *Player) {
+	if g.royale && !p.IsOut {
+		g.royaleCount--
+	}
+}
+
+// updateRoyale ends the battle royale when there is one survivor left,
+// and restarts it after a pause.
+func (g *Game) updateRoyale(now time.Time) {
+	if g.paused() {
+		if now.After(g.pauseEnd) {
+			g.startRoyale()
+			g.rotateRecording()
+			g.pauseEnd = time.Time{}
+			g.Broadcast(MsgRound(ROUND_START, 0))
+		}
+		return
+	}
+
+	survivor := -1
+	survivors := 0
+	for i := range g.players {
+		p := &g.players[i]
+		if p.IsValid && !p.IsOut {
+			survivor = i
+			survivors++
+		}
+	}
+	if survivors > 1 || g.royaleCount < 2 {
+		return
+	}
+
+	// The survivor wins, followed by the last players to be eliminated
+	var ranks []rank
+	if survivor != -1 {
+		ranks = append(ranks, rank{survivor, g.players[survivor].Kills})
+	}
+	for i := len(g.royaleOut) - 1; i >= 0 && len(ranks) < ROUND_TOP; i-- {
+		cn := g.royaleOut[i]
+		if g.players[cn].IsValid {
+			ranks = append(ranks, rank{cn, g.players[cn].Kills})
+		}
+	}
+	g.Broadcast(MsgRoundEnd(WinBySurvival, ranks))
+	g.pauseEnd = now.Add(ROUND_PAUSE)
+	g.Broadcast(MsgRound(ROUND_PAUSED, ROUND_PAUSE))
+}
+
+// startRoyale resets the arena and the zone, and lets every player back in.
+func (g *Game) startRoyale() {
+	g.resetArena()
+	g.resetZone()
+	g.royaleOut = g.royaleOut[:0]
+	g.royaleCount = 0
+	for i := range g.players {
+		p := &g.players[i]
+		if p.IsValid {
+			p.IsOut = false
+			g.royaleCount++
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package duel
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Skin constants
+const (
+	// Maximum number of skins (skin 0 means no skin)
+	MAX_SKINS = 0xFF
+	// Maximum length of a skin name
+	MAX_SKIN_LEN = 32
+)
+
+// skins are the names of the skins that players may choose.
+// Skin IDs start at 1, for the first name.
+var skins []string
+
+// LoadSkins sets the skins that players may choose from the names in a file,
+// one per line. Blank lines and lines starting with # are ignored.
+// Names may only contain lowercase letters, digits, '-' and '_'.
+// It must be called before any arena is started.
+func LoadSkins(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var names []string
+	seen := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if !validSkin(line) {
+			return fmt.Errorf("%v: invalid skin name %q", path, line)
+		}
+		if !seen[line] {
+			seen[line] = true
+			names = append(names, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if len(names) > MAX_SKINS {
+		return fmt.Errorf("%v: at most %v skins are allowed", path, MAX_SKINS)
+	}
+	if len(names) == 0 {
+		return errors.New("no skins in " + path)
+	}
+
+	skins = names
+	return nil
+}
+
+// validSkin checks if a skin name is allowed in the skin list.
+func validSkin(name string) bool {
+	if len(name) == 0 || len(name) > MAX_SKIN_LEN {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= '0' && r <= '9',
+			r >= 'a' && r <= 'z',
+			r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// skinID returns the ID of a skin, or 0 if it is not in the skin list.
+func skinID(name string) uint8 {
+	for i, s := range skins {
+		if s == name {
+			return uint8(i + 1)
+		}
+	}
+	return 0
+}
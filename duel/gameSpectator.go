@@ -0,0 +1,132 @@
+package duel
+
+// Spectator constants
+const (
+	// Maximum number of spectators in an arena
+	MAX_SPEC = 64
+	// Client number of spectators, which do not have a player slot
+	cnSpectator = -2
+)
+
+// Spectator cameras, other than following a client number
+const (
+	// Free camera, controlled by the client
+	FOLLOW_FREE = -1
+	// Follow the player with the most mass
+	FOLLOW_LEADER = -2
+)
+
+// AddSpectator adds a spectator to the game and returns a Client,
+// or nil if there are too many spectators.
+// Spectators receive everything that players do, but do not take a player slot.
+func (g *Game) AddSpectator(follow int) *Client {
+	g.pLock.Lock()
+	defer g.pLock.Unlock()
+
+	if len(g.spectators) >= MAX_SPEC {
+		return nil
+	}
+
+	c := newClient(g, cnSpectator)
+	c.spec = true
+	c.rgb = true
+	c.follow = follow
+	c.target = FOLLOW_FREE
+	c.SendB(MsgSpectate())
+	g.sendState(c.SendB, -1, true)
+
+	g.spectators[c] = struct{}{}
+	g.updateFollow(c, g.leader())
+	return c
+}
+
+// DelSpectator removes a spectator from the game.
+func (g *Game) DelSpectator(c *Client) {
+	g.pLock.Lock()
+	defer g.pLock.Unlock()
+
+	delete(g.spectators, c)
+}
+
+// NumSpectators returns the current number of spectators.
+func (g *Game) NumSpectators() int {
+	g.pLock.Lock()
+	defer g.pLock.Unlock()
+
+	return len(g.spectators)
+}
+
+// closeSpectators disconnects every spectator.
+func (g *Game) closeSpectators() {
+	g.pLock.Lock()
+	spectators := make([]*Client, 0, len(g.spectators))
+	for c := range g.spectators {
+		spectators = append(spectators, c)
+	}
+	g.pLock.Unlock()
+
+	for _, c := range spectators {
+		c.Close()
+	}
+}
+
+// recvSpectatorAction processes an action message from a spectator.
+func (g *Game) recvSpectatorAction(c *Client, act, arg byte) {
+	switch act {
+	case ACT_FOLLOW:
+		c.follow = int(arg)
+	case ACT_FOLLOW_LEADER:
+		c.follow = FOLLOW_LEADER
+	case ACT_FOLLOW_FREE:
+		c.follow = FOLLOW_FREE
+	default:
+		return
+	}
+	g.updateFollow(c, g.leader())
+}
+
+// leader returns the client number of the living player with the most mass,
+// or -1 if nobody is alive.
+func (g *Game) leader() int {
+	best := -1
+	var bestM uint
+	for i := range g.players {
+		p := &g.players[i]
+		if p.IsAlive && (best == -1 || p.M > bestM) {
+			best = i
+			bestM = p.M
+		}
+	}
+	return best
+}
+
+// updateFollow tells a spectator if the player it should be shown changed.
+// Spectators that follow a player who left are shown the leader instead.
+func (g *Game) updateFollow(c *Client, leader int) {
+	target := FOLLOW_FREE
+	switch {
+	case c.follow == FOLLOW_LEADER:
+		target = leader
+	case c.follow >= 0:
+		target = c.follow
+		if !g.players[target].IsValid {
+			target = leader
+		}
+	}
+
+	if target != c.target {
+		c.target = target
+		c.SendB(MsgFollow(target))
+	}
+}
+
+// updateSpectators updates the players shown to every spectator.
+func (g *Game) updateSpectators() {
+	if len(g.spectators) == 0 {
+		return
+	}
+	leader := g.leader()
+	for c := range g.spectators {
+		g.updateFollow(c, leader)
+	}
+}
@@ -0,0 +1,26 @@
+package duel
+
+import (
+	"log"
+
+	"victorz.ca/gameserv/stats"
+)
+
+// recordStats merges statistics into those of a remote player.
+// Bots and anonymous players are not recorded.
+func (g *Game) recordStats(p *Player, d stats.Stats) {
+	if g.store == nil || p.Client == nil || p.ID == "" {
+		return
+	}
+	if err := g.store.Add(p.ID, d); err != nil {
+		log.Printf("*stats for %v: %v\n", p.ID, err)
+	}
+}
+
+// recordPeak records the largest mass of a player since it last spawned.
+func (g *Game) recordPeak(p *Player) {
+	if p.peakMass != 0 {
+		g.recordStats(p, stats.Stats{DuelPeakMass: p.peakMass})
+		p.peakMass = 0
+	}
+}
@@ -0,0 +1,139 @@
+package duel
+
+import (
+	"fmt"
+	"time"
+)
+
+// Streak constants
+const (
+	// Maximum number of streak milestones
+	MAX_STREAKS = 16
+	// Speed multiplier of a speed boost
+	STREAK_SPEED_BOOST = 1.5
+	// Longest speed boost, in milliseconds
+	STREAK_SPEED_MAX = 60 * 1000
+)
+
+// Death flags, sent in MsgDeath
+const (
+	// The killer was the last player to kill the victim
+	DEATH_FLAG_REVENGE = 1 << 0
+)
+
+// StreakReward is what a player gets for reaching a streak milestone.
+type StreakReward uint8
+
+// Streak rewards
+const (
+	// The streak is only announced.
+	RewardNone StreakReward = iota
+	// Movement is faster for Amount milliseconds.
+	RewardSpeed
+	// The largest cell gains Amount mass.
+	RewardMass
+)
+
+// streakRewardNames are the names of streak rewards in JSON.
+var streakRewardNames = [...]string{
+	RewardNone:  "none",
+	RewardSpeed: "speed",
+	RewardMass:  "mass",
+}
+
+// MarshalText returns the name of a reward.
+func (r StreakReward) MarshalText() ([]byte, error) {
+	if int(r) >= len(streakRewardNames) {
+		return nil, fmt.Errorf("unknown streak reward %d", r)
+	}
+	return []byte(streakRewardNames[r]), nil
+}
+
+// UnmarshalText parses the name of a reward.
+func (r *StreakReward) UnmarshalText(b []byte) error {
+	for i, name := range streakRewardNames {
+		if string(b) == name {
+			*r = StreakReward(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown streak reward %q", b)
+}
+
+// Streak is a milestone reached when a player gets Combo kills without dying.
+// In JSON, the reward is "none", "speed" or "mass".
+type Streak struct {
+	Combo  uint         `json:"combo"`
+	Reward StreakReward `json:"reward"`
+	Amount uint         `json:"amount"`
+}
+
+// defaultStreaks are the streak milestones used when an arena is not configured.
+var defaultStreaks = []Streak{
+	{Combo: 3, Reward: RewardNone},
+	{Combo: 5, Reward: RewardSpeed, Amount: 5000},
+	{Combo: 10, Reward: RewardMass, Amount: PL_MASS_START},
+	{Combo: 20, Reward: RewardSpeed, Amount: 10000},
+}
+
+// validateStreaks checks that streak milestones are in increasing order
+// of at least two kills, with known rewards.
+func validateStreaks(streaks []Streak) error {
+	if len(streaks) > MAX_STREAKS {
+		return fmt.Errorf("at most %v streaks are allowed", MAX_STREAKS)
+	}
+	last := uint(1)
+	for _, s := range streaks {
+		if s.Combo <= last || s.Combo > 0xFFFF {
+			return fmt.Errorf("streak combos must be increasing, from 2 to %v", 0xFFFF)
+		}
+		if s.Reward > RewardMass {
+			return fmt.Errorf("unknown streak reward %v", s.Reward)
+		}
+		if s.Reward == RewardMass && s.Amount > PL_MASS_MAX {
+			return fmt.Errorf("streak mass must be at most %v", PL_MASS_MAX)
+		}
+		if s.Reward == RewardSpeed && s.Amount > STREAK_SPEED_MAX {
+			return fmt.Errorf("streak speed must last at most %v ms", STREAK_SPEED_MAX)
+		}
+		last = s.Combo
+	}
+	return nil
+}
+
+// checkStreak announces and rewards a player who reached a streak milestone.
+func (g *Game) checkStreak(p *Player, cn int) {
+	for _, s := range g.streaks {
+		if s.Combo != p.Combo {
+			continue
+		}
+
+		switch s.Reward {
+		case RewardSpeed:
+			p.boostEnd = g.frame + g.frames(time.Duration(s.Amount)*time.Millisecond)
+		case RewardMass:
+			if len(p.Cells) != 0 {
+				largest := &p.Cells[0]
+				for i := range p.Cells {
+					if p.Cells[i].M > largest.M {
+						largest = &p.Cells[i]
+					}
+				}
+				largest.addMass(s.Amount)
+				p.updateCells()
+			}
+		}
+		g.Broadcast(MsgStreak(cn, p.Combo, s.Reward))
+		return
+	}
+}
+
+// clearKiller forgets a player who left as the last killer of anyone,
+// so that a new player in the same slot cannot get revenge.
+func (g *Game) clearKiller(cn int) {
+	for i := range g.players {
+		if g.players[i].lastKiller == cn {
+			g.players[i].lastKiller = -1
+		}
+	}
+}
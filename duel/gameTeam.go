@@ -0,0 +1,77 @@
+package duel
+
+import (
+	"time"
+)
+
+// Team constants
+const (
+	// Maximum number of teams
+	MAX_TEAMS = 4
+	// Interval of team score updates
+	TEAM_SCORE_TIME = 1 * time.Second
+)
+
+// teamColors are the colors of players on each team.
+var teamColors = [MAX_TEAMS]int{
+	0xFF0000, // red
+	0x0000FF, // blue
+	0x00FF00, // green
+	0xFFFF00, // yellow
+}
+
+// sameTeam checks if two players are teammates.
+func sameTeam(a, b *Player) bool {
+	return a.Team != 0 && a.Team == b.Team
+}
+
+// assignTeam puts a player on the team with the fewest players,
+// and gives it the team color. It does nothing if teams are disabled.
+func (g *Game) assignTeam(p *Player) {
+	if g.teams == 0 {
+		return
+	}
+
+	var count [MAX_TEAMS]int
+	for i := range g.players {
+		pp := &g.players[i]
+		if pp.IsValid && pp != p && pp.Team != 0 {
+			count[pp.Team-1]++
+		}
+	}
+
+	best := 0
+	for t := 1; t < g.teams; t++ {
+		if count[t] < count[best] {
+			best = t
+		}
+	}
+
+	p.Team = uint8(best + 1)
+	p.Color = teamColors[best]
+}
+
+// teamScore is the total of a team.
+type teamScore struct {
+	M       uint  // mass of living players
+	Kills   uint  // kills of current players
+	members []int // client numbers
+}
+
+// teamScores returns the totals of each team.
+func (g *Game) teamScores() []teamScore {
+	scores := make([]teamScore, g.teams)
+	for i := range g.players {
+		p := &g.players[i]
+		if !p.IsValid || p.Team == 0 {
+			continue
+		}
+		t := &scores[p.Team-1]
+		if p.IsAlive {
+			t.M += p.M
+		}
+		t.Kills += p.Kills
+		t.members = append(t.members, i)
+	}
+	return scores
+}
@@ -0,0 +1,107 @@
+package duel
+
+import (
+	"log"
+	"time"
+)
+
+// Scheduler constants
+const (
+	// Longest sleep between slices
+	SLICE_TIME = 10 * time.Millisecond
+	// Maximum number of physics frames run in one slice to catch up.
+	// Frames further behind are dropped.
+	MAX_CATCHUP = 5
+	// Shortest interval between logs of dropped frames
+	DROP_LOG_TIME = 10 * time.Second
+)
+
+// TickStats describe how well an arena keeps up with its fixed timestep.
+// Durations are in nanoseconds.
+type TickStats struct {
+	// Physics frames run
+	Frames uint64 `json:"frames"`
+	// Physics frames dropped after falling more than MAX_CATCHUP frames behind
+	Dropped uint64 `json:"dropped"`
+	// World states not sent while catching up
+	Skipped uint64 `json:"skipped"`
+	// How far physics was behind at the start of the last slice, and at worst
+	Lag    time.Duration `json:"lag"`
+	MaxLag time.Duration `json:"max_lag"`
+	// How long the last slice took, on average, and at worst
+	Slice    time.Duration `json:"slice"`
+	AvgSlice time.Duration `json:"avg_slice"`
+	MaxSlice time.Duration `json:"max_slice"`
+}
+
+// Stats returns the scheduler statistics of the arena.
+func (g *Game) Stats() TickStats {
+	g.statsLock.Lock()
+	defer g.statsLock.Unlock()
+	return g.stats
+}
+
+// frames converts a duration to a number of physics frames, rounding up.
+func (g *Game) frames(d time.Duration) uint64 {
+	return uint64((d + g.physTime - 1) / g.physTime)
+}
+
+// decaySteps returns the number of times that mass decays in the current frame,
+// so that it decays every DECAY_TIME at any frame rate.
+func (g *Game) decaySteps() int {
+	t := time.Duration(g.frame) * g.physTime
+	return int(t/DECAY_TIME - (t-g.physTime)/DECAY_TIME)
+}
+
+// runPhysics runs the physics frames that are due, up to MAX_CATCHUP,
+// and drops the rest. It returns the number of frames run.
+func (g *Game) runPhysics(now time.Time) (frames int, lag time.Duration) {
+	lag = now.Sub(g.lastPhysics)
+	for frames < MAX_CATCHUP && !now.Before(g.lastPhysics) {
+		if !g.paused() {
+			g.PhysicsFrame()
+		}
+		g.lastPhysics = g.lastPhysics.Add(g.physTime)
+		frames++
+	}
+
+	if !now.Before(g.lastPhysics) {
+		dropped := now.Sub(g.lastPhysics)/g.physTime + 1
+		g.lastPhysics = g.lastPhysics.Add(dropped * g.physTime)
+		g.unloggedDrops += uint64(dropped)
+		if !now.Before(g.nextDropLog) {
+			log.Printf("*%v is overloaded, dropped %v frames\n", g.name, g.unloggedDrops)
+			g.unloggedDrops = 0
+			g.nextDropLog = now.Add(DROP_LOG_TIME)
+		}
+
+		g.statsLock.Lock()
+		g.stats.Dropped += uint64(dropped)
+		g.statsLock.Unlock()
+	}
+	return
+}
+
+// recordSlice updates the scheduler statistics after a slice.
+func (g *Game) recordSlice(frames int, skipped bool, lag, slice time.Duration) {
+	g.statsLock.Lock()
+	defer g.statsLock.Unlock()
+
+	s := &g.stats
+	s.Frames += uint64(frames)
+	if skipped {
+		s.Skipped++
+	}
+	if lag < 0 {
+		lag = 0
+	}
+	s.Lag = lag
+	if lag > s.MaxLag {
+		s.MaxLag = lag
+	}
+	s.Slice = slice
+	s.AvgSlice = (s.AvgSlice*15 + slice) / 16
+	if slice > s.MaxSlice {
+		s.MaxSlice = slice
+	}
+}
@@ -2,22 +2,110 @@ package duel
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"math"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Hello is what a client sends to join an arena.
+// Clients may send a binary message of a color from the 8-bit RGB palette
+// followed by the name, or a JSON text message, for example:
+//
+//	{"name": "Blob", "color": 16744448, "skin": "cat", "input": "joystick", "token": "..."}
+//	{"resume": "..."}
+//
+// Clients that send a JSON hello get 24-bit colors and skins in MsgEnter
+// and MsgTeamScores, and other clients get palette colors.
+type Hello struct {
+	Name   string `json:"name"`
+	Color  int    `json:"color"`  // 24-bit RGB
+	Skin   string `json:"skin"`   // name of a skin in the skin list
+	Input  string `json:"input"`  // "mouse" (the default) or "joystick"
+	Delta  bool   `json:"delta"`  // receive MsgWorldDelta instead of full world states
+	Token  string `json:"token"`  // session token of an account
+	Resume string `json:"resume"` // token from MsgResumeToken, to resume control
+
+	id  string // account name, once the token is verified
+	rgb bool   // sent as JSON, so the client understands 24-bit colors
+}
+
+// InputMode is how a client controls movement.
+type InputMode uint8
+
+// Input modes, sent in MsgWelcome
+const (
+	// Clients send the destination of the player, for a mouse.
+	InputMouse InputMode = iota
+	// Clients send a direction and a magnitude, for touch screens and gamepads.
+	InputJoystick
+)
+
+// inputMode returns the input mode that the client asked for.
+func (h *Hello) inputMode() InputMode {
+	if h.Input == "joystick" {
+		return InputJoystick
+	}
+	return InputMouse
+}
+
 // processHello processes the first incoming message.
-func processHello(c *websocket.Conn) (name []byte, col uint8) {
-	mt, h, err := c.ReadMessage()
+func processHello(c *websocket.Conn) *Hello {
+	h := new(Hello)
+	mt, msg, err := c.ReadMessage()
+	if err != nil {
+		return h
+	}
 
-	if mt != websocket.BinaryMessage || err != nil || len(h) < 1 {
-		return
+	switch mt {
+	case websocket.BinaryMessage:
+		if len(msg) >= 1 {
+			h.Name = string(msg[1:])
+			h.Color = paletteColor(msg[0])
+		}
+	case websocket.TextMessage:
+		if err := json.Unmarshal(msg, h); err != nil {
+			return new(Hello)
+		}
+		h.rgb = true
 	}
+	return h
+}
 
-	name = h[1:]
-	col = h[0]
-	return
+// Actions, sent as 2-byte messages of an action and an argument
+const (
+	// Split every large enough cell
+	ACT_SPLIT = 1
+	// Eject mass from every large enough cell
+	ACT_EJECT = 2
+	// Spectators: follow the client number in the argument
+	ACT_FOLLOW = 3
+	// Spectators: follow the player with the most mass
+	ACT_FOLLOW_LEADER = 4
+	// Spectators: stop following, for a free camera
+	ACT_FOLLOW_FREE = 5
+	// Stop moving
+	ACT_STOP = 6
+	// Acknowledge the MsgWorldDelta numbered in the argument
+	ACT_ACK = 7
+)
+
+// recvAction processes an action message.
+func recvAction(p *Player, act, arg byte) {
+	switch act {
+	case ACT_SPLIT:
+		p.wantSplit = true
+	case ACT_EJECT:
+		p.wantEject = true
+	case ACT_STOP:
+		p.D = p.O
+		p.Speed = 0
+	case ACT_ACK:
+		if p.Client != nil {
+			p.Client.ack(arg)
+		}
+	}
 }
 
 // Recv processes incoming messages after the hello message.
@@ -40,12 +128,25 @@ func Recv(c *Client, msg []byte) {
 			}
 			c.ping = uint16(newPing)
 		}
+	} else if c.spec {
+		if len(msg) == 2 {
+			c.g.recvSpectatorAction(c, msg[0], msg[1])
+		}
 	} else {
 		p := &c.g.players[c.cn]
-		if len(msg) == 4 {
-			// movement
-			p.D.X = float64(binary.BigEndian.Uint16(msg)) * (MAX_W / 0xFFFF)
-			p.D.Y = float64(binary.BigEndian.Uint16(msg[2:])) * (MAX_H / 0xFFFF)
+		if len(msg) == 4 && p.input == InputMouse {
+			// movement to a destination
+			m := c.g.m
+			p.D.X = float64(binary.BigEndian.Uint16(msg)) * (m.W / 0xFFFF)
+			p.D.Y = float64(binary.BigEndian.Uint16(msg[2:])) * (m.H / 0xFFFF)
+			p.Speed = 1
+		} else if len(msg) == 3 && p.input == InputJoystick {
+			// movement in a direction (clockwise from +X), at a fraction of full speed
+			angle := float64(binary.BigEndian.Uint16(msg)) * (2 * math.Pi / 0x10000)
+			p.Dir = Vec2{math.Cos(angle), math.Sin(angle)}
+			p.Speed = float64(msg[2]) / 0xFF
+		} else if len(msg) == 2 {
+			recvAction(p, msg[0], msg[1])
 		} else if len(msg) == 1 {
 			// spawn
 			wantSpawn := msg[0] != 0
@@ -58,74 +159,370 @@ func Recv(c *Client, msg []byte) {
 	}
 }
 
-func MsgWelcome(cn int) []byte {
-	return []byte{0, byte(cn)}
+// MsgWelcome tells a player its client number, and the input mode it must use.
+func MsgWelcome(cn int, input InputMode) []byte {
+	return []byte{0, byte(cn), byte(input)}
+}
+
+// MsgResumeToken gives a player the token that resumes control of it
+// after disconnecting. It is only sent to clients that sent a JSON hello.
+func MsgResumeToken(token string) []byte {
+	return append([]byte{21}, token...)
 }
 
-func msgEnter(code, cn int, col uint8, k, d, c, s uint, name string) []byte {
-	b := make([]byte, 19+len(name))
+func msgEnter(code, cn int, p *Player, rgb bool) []byte {
+	n := 19
+	if rgb {
+		n = 22
+	}
+	b := make([]byte, n+len(p.Name))
 	b[0] = byte(code)
 	b[1] = byte(cn)
-	binary.BigEndian.PutUint32(b[2:], uint32(k))
-	binary.BigEndian.PutUint32(b[6:], uint32(d))
-	binary.BigEndian.PutUint32(b[10:], uint32(c))
-	binary.BigEndian.PutUint32(b[14:], uint32(s))
-	b[18] = col
-	copy(b[19:], name)
+	binary.BigEndian.PutUint32(b[2:], uint32(p.Kills))
+	binary.BigEndian.PutUint32(b[6:], uint32(p.Deaths))
+	binary.BigEndian.PutUint32(b[10:], uint32(p.Combo))
+	binary.BigEndian.PutUint32(b[14:], uint32(p.Score))
+	if rgb {
+		b[18] = byte(p.Color >> 16)
+		b[19] = byte(p.Color >> 8)
+		b[20] = byte(p.Color)
+		b[21] = p.Skin
+	} else {
+		b[18] = colorPalette(p.Color)
+	}
+	copy(b[n:], p.Name)
 	return b
 }
 
-func MsgEnter(cn int, col uint8, k, d, c, s uint, name string) []byte {
-	return msgEnter(1, cn, col, k, d, c, s, name)
+// MsgEnter announces a remote player: its kills, deaths, combo, score,
+// color and name. With rgb, the color is 24-bit and followed by the skin ID
+// (see MsgSkins). Otherwise, it is from the 8-bit RGB palette.
+func MsgEnter(cn int, p *Player, rgb bool) []byte {
+	return msgEnter(1, cn, p, rgb)
 }
 
-func MsgEnterBot(cn int, col uint8, k, d, c, s uint, name string) []byte {
-	return msgEnter(2, cn, col, k, d, c, s, name)
+// MsgEnterBot announces a bot, in the same format as MsgEnter.
+func MsgEnterBot(cn int, p *Player, rgb bool) []byte {
+	return msgEnter(2, cn, p, rgb)
 }
 
 func MsgLeave(cn int) []byte {
 	return []byte{3, byte(cn)}
 }
 
-func buildWorldState(g *Game) []byte {
-	// Pre-allocate size
-	n := uint(0)
-	for i := range g.players {
-		p := &g.players[i]
-		if p.IsAlive {
-			n++
+// buildWorldState lists every cell of every living player in a snapshot:
+// its client number, position, destination of the player, and mass.
+// Players with several cells have one entry for each cell.
+func buildWorldState(s *snapshot) []byte {
+	msg := make([]byte, 1+13*len(s.cells))
+	msg[0] = 4
+	for i, c := range s.cells {
+		b := msg[1+13*i:]
+		b[0] = c.cn
+		binary.BigEndian.PutUint16(b[1:], c.x)
+		binary.BigEndian.PutUint16(b[3:], c.y)
+		binary.BigEndian.PutUint16(b[5:], c.dx)
+		binary.BigEndian.PutUint16(b[7:], c.dy)
+		binary.BigEndian.PutUint32(b[9:], c.m)
+	}
+	return msg
+}
+
+// Fields of a cell in MsgWorldDelta
+const (
+	// Position changed by a small amount: dx, dy int8
+	DELTA_MOVE = 1 << 0
+	// Position: x, y uint16
+	DELTA_POS = 1 << 1
+	// Destination of the player: x, y uint16
+	DELTA_DEST = 1 << 2
+	// Mass: uint32
+	DELTA_MASS = 1 << 3
+)
+
+// MsgWorldDelta is a world state for clients using delta encoding.
+// It has the snapshot number to acknowledge with ACT_ACK, the snapshot number
+// of the base it is relative to, and a flag that is 0 without a base.
+// Then come the number of removed cells (uint16) and their client numbers and
+// cell indexes. The rest of the message lists the cells that are new or changed:
+// client number, cell index, fields that changed (see DELTA_MOVE), and the fields.
+func MsgWorldDelta(s, base *snapshot) []byte {
+	b := []byte{20, byte(s.seq), 0, 0, 0, 0}
+	var old []cellState
+	if base != nil {
+		b[2] = byte(base.seq)
+		b[3] = 1
+		old = base.cells
+	}
+
+	// Both lists are sorted, so walk them together
+	var changed []byte
+	removed := 0
+	i := 0
+	for _, c := range s.cells {
+		for i < len(old) && (old[i].cn < c.cn || old[i].cn == c.cn && old[i].cell < c.cell) {
+			b = append(b, old[i].cn, old[i].cell)
+			removed++
+			i++
 		}
+
+		var o *cellState
+		if i < len(old) && old[i].cn == c.cn && old[i].cell == c.cell {
+			o = &old[i]
+			i++
+		}
+		changed = appendCellDelta(changed, &c, o)
+	}
+	for ; i < len(old); i++ {
+		b = append(b, old[i].cn, old[i].cell)
+		removed++
 	}
 
-	// Build message
-	msg := make([]byte, n*13+1)
-	msg[0] = 4
+	binary.BigEndian.PutUint16(b[4:], uint16(removed))
+	return append(b, changed...)
+}
 
-	n = 1
+// appendCellDelta appends the fields of c that differ from o,
+// or every field if o is nil. Nothing is appended if c is unchanged.
+func appendCellDelta(b []byte, c, o *cellState) []byte {
+	var mask byte
+	ddx, ddy := 0, 0
+	if o == nil {
+		mask = DELTA_POS | DELTA_DEST | DELTA_MASS
+	} else {
+		ddx, ddy = int(c.x)-int(o.x), int(c.y)-int(o.y)
+		if ddx != 0 || ddy != 0 {
+			if ddx >= math.MinInt8 && ddx <= math.MaxInt8 &&
+				ddy >= math.MinInt8 && ddy <= math.MaxInt8 {
+				mask |= DELTA_MOVE
+			} else {
+				mask |= DELTA_POS
+			}
+		}
+		if c.dx != o.dx || c.dy != o.dy {
+			mask |= DELTA_DEST
+		}
+		if c.m != o.m {
+			mask |= DELTA_MASS
+		}
+		if mask == 0 {
+			return b
+		}
+	}
+
+	b = append(b, c.cn, c.cell, mask)
+	if mask&DELTA_MOVE != 0 {
+		b = append(b, byte(int8(ddx)), byte(int8(ddy)))
+	}
+	if mask&DELTA_POS != 0 {
+		b = binary.BigEndian.AppendUint16(b, c.x)
+		b = binary.BigEndian.AppendUint16(b, c.y)
+	}
+	if mask&DELTA_DEST != 0 {
+		b = binary.BigEndian.AppendUint16(b, c.dx)
+		b = binary.BigEndian.AppendUint16(b, c.dy)
+	}
+	if mask&DELTA_MASS != 0 {
+		b = binary.BigEndian.AppendUint32(b, c.m)
+	}
+	return b
+}
+
+// MsgDeath reports that a player died, with the cause of death, a detail
+// that explains it (see DEATH_ROLL and DEATH_MASS), and flags (see DEATH_FLAG_REVENGE).
+func MsgDeath(killer, victim int, reason, detail, flags byte) []byte {
+	return []byte{5, byte(killer), byte(victim), reason, detail, flags}
+}
+
+// MsgPingTime reports the ping of a player, in milliseconds.
+func MsgPingTime(cn int, ping uint16) []byte {
+	b := [4]byte{6, byte(cn)}
+	binary.BigEndian.PutUint16(b[2:], ping)
+	return b[:]
+}
+
+// MsgPingTimes reports the ping of every remote player with a measured ping,
+// in the same format as MsgPingTime, repeated for each player.
+func MsgPingTimes(g *Game) []byte {
+	b := []byte{6}
 	for i := range g.players {
 		p := &g.players[i]
-		if p.IsAlive {
-			b := msg[n:]
-			b[0] = byte(i)
-			binary.BigEndian.PutUint16(b[1:], uint16(p.O.X*(0xFFFF/MAX_W)))
-			binary.BigEndian.PutUint16(b[3:], uint16(p.O.Y*(0xFFFF/MAX_H)))
-			binary.BigEndian.PutUint16(b[5:], uint16(p.D.X*(0xFFFF/MAX_W)))
-			binary.BigEndian.PutUint16(b[7:], uint16(p.D.Y*(0xFFFF/MAX_H)))
-			binary.BigEndian.PutUint32(b[9:], uint32(p.M))
-			n += 13
+		if !p.IsValid || p.Client == nil || p.Client.ping == 0xFFFF {
+			continue
 		}
+		b = append(b, MsgPingTime(i, p.Client.ping)[1:]...)
 	}
+	return b
+}
 
-	return msg
+func msgFood(code int, g *Game, ids []int) []byte {
+	b := make([]byte, 1+7*len(ids))
+	b[0] = byte(code)
+	m := g.m
+	for i, id := range ids {
+		f := &g.food[id]
+		e := b[1+7*i:]
+		binary.BigEndian.PutUint16(e, uint16(id))
+		binary.BigEndian.PutUint16(e[2:], uint16(f.O.X*(0xFFFF/m.W)))
+		binary.BigEndian.PutUint16(e[4:], uint16(f.O.Y*(0xFFFF/m.H)))
+		e[6] = byte(f.M)
+	}
+	return b
 }
 
-func MsgDeath(killer, victim int) []byte {
-	return []byte{5, byte(killer), byte(victim)}
+// MsgFoodSnapshot lists every pellet, replacing any that the client knows.
+func MsgFoodSnapshot(g *Game) []byte {
+	ids := make([]int, 0, MAX_FOOD)
+	for i := range g.food {
+		if g.food[i].IsAlive {
+			ids = append(ids, i)
+		}
+	}
+	return msgFood(8, g, ids)
 }
 
-func MsgPingTime(cn int, ping uint16) []byte {
-	b := [3]byte{6}
-	binary.BigEndian.PutUint16(b[1:], ping)
+// MsgFoodAdd lists new or moved pellets, replacing any that the client knows.
+func MsgFoodAdd(g *Game, ids []int) []byte {
+	return msgFood(9, g, ids)
+}
+
+// MsgFoodDel lists removed pellets.
+func MsgFoodDel(ids []int) []byte {
+	b := make([]byte, 1+2*len(ids))
+	b[0] = 10
+	for i, id := range ids {
+		binary.BigEndian.PutUint16(b[1+2*i:], uint16(id))
+	}
+	return b
+}
+
+// MsgTeamScores lists, for each team, its color, total mass, total kills,
+// and client numbers of its members. Colors are 24-bit with rgb,
+// and from the 8-bit RGB palette otherwise.
+func MsgTeamScores(scores []teamScore, rgb bool) []byte {
+	b := []byte{11}
+	for i := range scores {
+		t := &scores[i]
+		if rgb {
+			b = append(b, byte(teamColors[i]>>16), byte(teamColors[i]>>8), byte(teamColors[i]))
+		} else {
+			b = append(b, colorPalette(teamColors[i]))
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(t.M))
+		b = binary.BigEndian.AppendUint32(b, uint32(t.Kills))
+		b = append(b, byte(len(t.members)))
+		for _, cn := range t.members {
+			b = append(b, byte(cn))
+		}
+	}
+	return b
+}
+
+// MsgMap describes the map of the arena, in map units:
+// its size, obstacles (0 for circles with a radius, 1 for rectangles),
+// and spawn zones.
+func MsgMap(m *Map) []byte {
+	b := make([]byte, 6, 6+9*len(m.Obstacles)+1+8*len(m.Spawns))
+	b[0] = 12
+	binary.BigEndian.PutUint16(b[1:], uint16(m.W))
+	binary.BigEndian.PutUint16(b[3:], uint16(m.H))
+	b[5] = byte(len(m.Obstacles))
+	for _, ob := range m.Obstacles {
+		var e [9]byte
+		binary.BigEndian.PutUint16(e[1:], uint16(ob.X))
+		binary.BigEndian.PutUint16(e[3:], uint16(ob.Y))
+		if ob.R > 0 {
+			e[0] = 0
+			binary.BigEndian.PutUint16(e[5:], uint16(ob.R))
+			b = append(b, e[:7]...)
+		} else {
+			e[0] = 1
+			binary.BigEndian.PutUint16(e[5:], uint16(ob.W))
+			binary.BigEndian.PutUint16(e[7:], uint16(ob.H))
+			b = append(b, e[:]...)
+		}
+	}
+	b = append(b, byte(len(m.Spawns)))
+	for _, sp := range m.Spawns {
+		var e [8]byte
+		binary.BigEndian.PutUint16(e[0:], uint16(sp.X))
+		binary.BigEndian.PutUint16(e[2:], uint16(sp.Y))
+		binary.BigEndian.PutUint16(e[4:], uint16(sp.W))
+		binary.BigEndian.PutUint16(e[6:], uint16(sp.H))
+		b = append(b, e[:]...)
+	}
+	return b
+}
+
+// MsgRound reports the phase of the round (see ROUND_START),
+// and the seconds remaining in the round or pause.
+func MsgRound(phase byte, remaining time.Duration) []byte {
+	secs := (remaining + time.Second - 1) / time.Second
+	if secs < 0 {
+		secs = 0
+	} else if secs > 0xFFFF {
+		secs = 0xFFFF
+	}
+	b := [4]byte{13, phase}
+	binary.BigEndian.PutUint16(b[2:], uint16(secs))
+	return b[:]
+}
+
+// MsgRoundEnd announces how the winner was chosen (see WinByScore),
+// and the best players of the round, starting with the winner.
+func MsgRoundEnd(mode RoundWinMode, ranks []rank) []byte {
+	b := make([]byte, 3+5*len(ranks))
+	b[0] = 14
+	b[1] = byte(mode)
+	b[2] = byte(len(ranks))
+	for i, r := range ranks {
+		e := b[3+5*i:]
+		e[0] = byte(r.cn)
+		binary.BigEndian.PutUint32(e[1:], uint32(r.value))
+	}
+	return b
+}
+
+// MsgZone describes the playable region of a battle royale, in map units.
+func MsgZone(z *royaleZone) []byte {
+	b := [7]byte{15}
+	binary.BigEndian.PutUint16(b[1:], uint16(z.O.X))
+	binary.BigEndian.PutUint16(b[3:], uint16(z.O.Y))
+	binary.BigEndian.PutUint16(b[5:], uint16(math.Ceil(z.R)))
+	return b[:]
+}
+
+// MsgSpectate welcomes a spectator, instead of MsgWelcome.
+func MsgSpectate() []byte {
+	return []byte{16}
+}
+
+// MsgFollow tells a spectator which client number to show,
+// or to use a free camera if cn is -1.
+func MsgFollow(cn int) []byte {
+	if cn == -1 {
+		return []byte{17, 0, 0}
+	}
+	return []byte{17, 1, byte(cn)}
+}
+
+// MsgSkins lists the names of the skins, in order of skin ID starting at 1.
+// Each name is preceded by its length.
+func MsgSkins() []byte {
+	b := []byte{18, byte(len(skins))}
+	for _, s := range skins {
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+// MsgStreak announces that a player reached a streak milestone of combo kills,
+// and the reward it got (see RewardNone).
+func MsgStreak(cn int, combo uint, reward StreakReward) []byte {
+	b := [5]byte{19, byte(cn)}
+	binary.BigEndian.PutUint16(b[2:], uint16(combo))
+	b[4] = byte(reward)
 	return b[:]
 }
 
@@ -2,26 +2,91 @@
 package duel
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
+
+	"victorz.ca/gameserv/origin"
 )
 
-// HandleNum responds to the HTTP request by writing the current number of players.
-func (g *Game) HandleNum(w http.ResponseWriter, r *http.Request) {
-	n := g.pCount
-	fmt.Fprintf(w, "%v", n)
+// HandleNum responds to the HTTP request by writing the total number of players,
+// followed by one line for each arena with its name and number of players.
+func (m *Manager) HandleNum(w http.ResponseWriter, r *http.Request) {
+	counts := m.counts()
+	total := 0
+	for _, c := range counts {
+		total += c.n
+	}
+	fmt.Fprintf(w, "%v\n", total)
+	for _, c := range counts {
+		fmt.Fprintf(w, "%v %v\n", c.name, c.n)
+	}
+}
+
+// HandleBots responds to the HTTP request by writing the target population
+// of each arena, one per line.
+// If the "arena", "target" and "key" query parameters are given, and the key
+// matches the AdminKey, the target population of that arena is changed first.
+func (m *Manager) HandleBots(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if target := q.Get("target"); target != "" {
+		key := q.Get("key")
+		if m.AdminKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(m.AdminKey)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		n, err := strconv.Atoi(target)
+		if err != nil {
+			http.Error(w, "bad target", http.StatusBadRequest)
+			return
+		}
+		g := m.Arena(q.Get("arena"))
+		if g == nil {
+			http.Error(w, "no such arena", http.StatusNotFound)
+			return
+		}
+		g.SetPopulation(n)
+		log.Printf("*[%v] %v target population set to %v\n", r.RemoteAddr, g.name, g.Population())
+	}
+
+	for _, c := range m.counts() {
+		fmt.Fprintf(w, "%v %v\n", c.name, c.pop)
+	}
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+// HandleStats responds to the HTTP request with the scheduler statistics
+// of each arena as a JSON object, keyed by arena name.
+func (m *Manager) HandleStats(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]TickStats)
+	for _, g := range m.games() {
+		stats[g.name] = g.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
 }
 
+// upgrader upgrades connections to the arenas and replays,
+// whose origins are checked before upgrading.
+var upgrader = origin.Upgrader()
+
 // HandlePlayer serves a game client.
-func (g *Game) HandlePlayer(w http.ResponseWriter, r *http.Request) {
+// The arena may be chosen with the "arena" query parameter.
+// With the "spectate" query parameter, the client is a spectator, and may
+// choose a client number or "leader" to follow with the "follow" query parameter.
+func (m *Manager) HandlePlayer(w http.ResponseWriter, r *http.Request) {
 	log.Printf(" [%v] connected\n", r.RemoteAddr)
+	_, spectate := r.URL.Query()["spectate"]
+	if !m.Origins.Allow(r, spectate) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("*[%v] upgrade failed: %v\n", r.RemoteAddr, err)
@@ -30,21 +95,161 @@ func (g *Game) HandlePlayer(w http.ResponseWriter, r *http.Request) {
 	defer log.Printf(" [%v] disconnected\n", r.RemoteAddr)
 	defer c.Close()
 
-	cl := g.AddPlayer(processHello(c))
+	if spectate {
+		m.serveSpectator(c, r)
+		return
+	}
+
+	h := processHello(c)
+	var g *Game
+	var cl *Client
+	if h.Resume != "" {
+		g, cl = m.Resume(h.Resume)
+		if cl == nil {
+			log.Printf("*[%v] cannot resume\n", r.RemoteAddr)
+			msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "cannot resume")
+			c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			return
+		}
+	} else {
+		h.Name, h.id = m.Auth.Identify(h.Token, filterName([]byte(h.Name)))
+		g, cl = m.Join(r.URL.Query().Get("arena"), h)
+	}
 	if cl == nil {
+		log.Printf("*[%v] arena is full\n", r.RemoteAddr)
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "arena is full")
+		c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
 		return
 	}
 
-	name := g.players[cl.cn].Name
+	pname := g.players[cl.cn].Name
+
+	n := g.NumPlayers()
+	log.Printf("+[%v] %v in %v (%v now)\n", r.RemoteAddr, pname, g.name, n)
+
+	go reader(cl, c)
+	writer(cl, c)
+
+	n = g.NumPlayers()
+	log.Printf("-[%v] %v in %v (%v total)\n", r.RemoteAddr, pname, g.name, n)
+}
+
+// serveSpectator serves a spectator client.
+func (m *Manager) serveSpectator(c *websocket.Conn, r *http.Request) {
+	q := r.URL.Query()
+	follow := FOLLOW_FREE
+	if f := q.Get("follow"); f == "leader" {
+		follow = FOLLOW_LEADER
+	} else if cn, err := strconv.Atoi(f); err == nil && cn >= 0 && cn < MAX_PL {
+		follow = cn
+	}
+
+	g, cl := m.Spectate(q.Get("arena"), follow)
+	if cl == nil {
+		log.Printf("*[%v] cannot spectate\n", r.RemoteAddr)
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "cannot spectate")
+		c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		return
+	}
 
-	n := g.pCount
-	log.Printf("+[%v] %v (%v now)\n", r.RemoteAddr, name, n)
+	log.Printf("+[%v] spectating %v\n", r.RemoteAddr, g.name)
 
 	go reader(cl, c)
 	writer(cl, c)
 
-	n = g.pCount
-	log.Printf("-[%v] %v (%v total)\n", r.RemoteAddr, name, n)
+	log.Printf("-[%v] spectated %v\n", r.RemoteAddr, g.name)
+}
+
+// HandleReplay serves a recorded replay, named by the "file" query parameter,
+// to a client as if it was a spectator. The "speed" query parameter may be
+// used to play it up to REPLAY_SPEED_MAX times faster.
+// Without a websocket upgrade, the names of the replays are listed instead.
+func (m *Manager) HandleReplay(w http.ResponseWriter, r *http.Request) {
+	if m.ReplayDir == "" {
+		http.Error(w, "replays are disabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	if !websocket.IsWebSocketUpgrade(r) {
+		names, err := listReplays(m.ReplayDir)
+		if err != nil {
+			http.Error(w, "cannot list replays", http.StatusInternalServerError)
+			return
+		}
+		for _, name := range names {
+			fmt.Fprintf(w, "%v\n", name)
+		}
+		return
+	}
+
+	speed := 1.0
+	if s := q.Get("speed"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 1 || f > REPLAY_SPEED_MAX {
+			http.Error(w, "bad speed", http.StatusBadRequest)
+			return
+		}
+		speed = f
+	}
+
+	rr, err := openReplay(m.ReplayDir, q.Get("file"))
+	if err != nil {
+		http.Error(w, "no such replay", http.StatusNotFound)
+		return
+	}
+	defer rr.Close()
+
+	if !m.Origins.Allow(r, true) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("*[%v] upgrade failed: %v\n", r.RemoteAddr, err)
+		return
+	}
+	defer c.Close()
+
+	log.Printf("+[%v] replaying %v\n", r.RemoteAddr, q.Get("file"))
+	defer log.Printf("-[%v] replayed %v\n", r.RemoteAddr, q.Get("file"))
+
+	// Messages from the client are ignored, until it disconnects
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for {
+		e, err := rr.next()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("*[%v] replay failed: %v\n", r.RemoteAddr, err)
+			}
+			break
+		}
+
+		wait := time.Duration(float64(e.t)/speed) - time.Since(start)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-closed:
+				return
+			}
+		}
+		if err := c.WriteMessage(websocket.BinaryMessage, e.msg); err != nil {
+			return
+		}
+	}
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "end of replay")
+	c.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
 }
 
 func reader(c *Client, conn *websocket.Conn) {
@@ -0,0 +1,212 @@
+// Package origin implements an allowlist of the websites whose pages
+// may connect to the game servers, with a policy for each origin.
+package origin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Allowlist constants
+const (
+	// Maximum number of origins whose rejections are counted separately
+	MAX_COUNTED = 256
+	// Key under which other rejected origins are counted
+	OTHER = "other"
+)
+
+// Policy is an origin pattern, and what pages from matching origins may do.
+//
+// Patterns are "*" for any origin, or a host with an optional scheme and port,
+// where a leading "*." matches any subdomain, but not the domain itself:
+//
+//	https://example.com
+//	*.example.com
+//	http://*.example.com:8080
+type Policy struct {
+	Origin string `json:"origin"`
+	// Pages may only spectate, and not play.
+	SpectateOnly bool `json:"spectate_only"`
+}
+
+// rule is a parsed Policy.
+type rule struct {
+	scheme   string // or blank for any scheme
+	host     string // with the port, if any
+	any      bool   // matches every origin
+	wildcard bool   // matches subdomains of host
+	policy   Policy
+}
+
+// parse parses the pattern of a policy.
+func parse(p Policy) (rule, error) {
+	r := rule{policy: p}
+	s := strings.ToLower(p.Origin)
+	if s == "*" {
+		r.any = true
+		return r, nil
+	}
+	if i := strings.Index(s, "://"); i != -1 {
+		r.scheme, s = s[:i], s[i+3:]
+		if r.scheme != "http" && r.scheme != "https" {
+			return r, fmt.Errorf("origin %q: scheme must be http or https", p.Origin)
+		}
+	}
+	if strings.HasPrefix(s, "*.") {
+		r.wildcard, s = true, s[2:]
+	}
+	if s == "" || strings.ContainsAny(s, "*/?#@ ") || strings.HasPrefix(s, ".") {
+		return r, fmt.Errorf("origin %q: bad host", p.Origin)
+	}
+	r.host = s
+	return r, nil
+}
+
+// match checks if an origin, with a lowercase scheme and host, matches the rule.
+func (r *rule) match(scheme, host string) bool {
+	switch {
+	case r.any:
+		return true
+	case r.scheme != "" && r.scheme != scheme:
+		return false
+	case r.wildcard:
+		return strings.HasSuffix(host, "."+r.host)
+	default:
+		return host == r.host
+	}
+}
+
+// Allowlist decides which origins may connect, and counts those that are rejected.
+// Pages on the server's own host, and clients that send no origin,
+// such as native clients, may always play.
+type Allowlist struct {
+	// AdminKey must be presented to see the numbers of rejected connections.
+	// If it is blank, they cannot be seen over HTTP.
+	AdminKey string
+
+	rules []rule
+
+	rejected uint64
+	counts   map[string]uint64 // rejections by origin
+	lock     sync.Mutex
+}
+
+// New makes an Allowlist of policies. The first policy that matches an origin applies.
+func New(policies []Policy) (*Allowlist, error) {
+	a := &Allowlist{counts: make(map[string]uint64)}
+	for _, p := range policies {
+		r, err := parse(p)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+	}
+	return a, nil
+}
+
+// lookup returns the policy of the origin of a request,
+// or false if the origin is not allowed.
+func (a *Allowlist) lookup(r *http.Request, o string) (Policy, bool) {
+	if o == "" {
+		return Policy{}, true
+	}
+	u, err := url.Parse(o)
+	if err != nil {
+		return Policy{}, false
+	}
+	host := strings.ToLower(u.Host)
+	if host == strings.ToLower(r.Host) {
+		return Policy{}, true
+	}
+	if a == nil {
+		return Policy{}, false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	for i := range a.rules {
+		if a.rules[i].match(scheme, host) {
+			return a.rules[i].policy, true
+		}
+	}
+	return Policy{}, false
+}
+
+// Upgrader returns a websocket upgrader that accepts every origin,
+// for handlers that check origins with Allow before upgrading.
+func Upgrader() websocket.Upgrader {
+	return websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+}
+
+// Allow checks if the page that made a request may connect,
+// either to play, or to only spectate.
+// Rejected requests are logged and counted. If a is nil,
+// only pages on the server's own host may connect.
+func (a *Allowlist) Allow(r *http.Request, spectate bool) bool {
+	o := r.Header.Get("Origin")
+	p, ok := a.lookup(r, o)
+	reason := "not allowed"
+	if ok && p.SpectateOnly && !spectate {
+		ok = false
+		reason = "spectate only"
+	}
+	if ok {
+		return true
+	}
+
+	log.Printf("*[%v] origin %v rejected: %v\n", r.RemoteAddr, o, reason)
+	if a != nil {
+		a.count(o)
+	}
+	return false
+}
+
+// count counts a rejection of an origin.
+func (a *Allowlist) count(o string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.rejected++
+	if _, ok := a.counts[o]; !ok && len(a.counts) >= MAX_COUNTED {
+		o = OTHER
+	}
+	a.counts[o]++
+}
+
+// Stats are the numbers of rejected connections.
+type Stats struct {
+	Rejected uint64            `json:"rejected"`
+	ByOrigin map[string]uint64 `json:"by_origin"`
+}
+
+// Stats returns the numbers of rejected connections since the server started.
+func (a *Allowlist) Stats() Stats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	s := Stats{Rejected: a.rejected, ByOrigin: make(map[string]uint64, len(a.counts))}
+	for o, n := range a.counts {
+		s.ByOrigin[o] = n
+	}
+	return s
+}
+
+// HandleStats responds to the HTTP request with the Stats as a JSON object,
+// if the "key" query parameter matches the AdminKey.
+func (a *Allowlist) HandleStats(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if a.AdminKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(a.AdminKey)) != 1 {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.Stats())
+}
@@ -3,18 +3,16 @@ package slime
 import (
 	"math/rand"
 	"time"
+
+	"victorz.ca/gameserv/stats"
 )
 
 // Timing constants
 const (
-	// Physics frames per second
+	// Default physics frames per second
 	PHYS_FPS = 50
-	// Network world states per second
+	// Default network world states per second
 	NETW_FPS = 25
-	// Interval of physics frames
-	PHYS_TIME = time.Second / PHYS_FPS
-	// Interval of world state updates
-	NETW_TIME = time.Second / NETW_FPS
 	// Interval of pings
 	PING_TIME = 250 * time.Millisecond
 )
@@ -58,17 +56,32 @@ type Ball struct {
 	MoveState
 }
 
+// score is the progress of a match.
+type score struct {
+	winner             int  // winner of the current round, 0 while it is played, 3 before the first round
+	p1First            bool // player 1 serves the current round
+	p1Points, p2Points int
+}
+
 // Game represents the game state
 type Game struct {
 	P1, P2 *Player
 	B      Ball
+
+	physFPS  float64
+	physTime time.Duration // interval of physics frames
+	netTime  time.Duration // interval of world state updates
+	store    stats.Store
 }
 
-// NewGame creates a game for two players.
+// NewGame creates a game for two players with the default rates.
 func NewGame(p1, p2 *Player) Game {
 	return Game{
-		P1: p1,
-		P2: p2,
+		P1:       p1,
+		P2:       p2,
+		physFPS:  PHYS_FPS,
+		physTime: time.Second / PHYS_FPS,
+		netTime:  time.Second / NETW_FPS,
 	}
 }
 
@@ -184,9 +197,9 @@ func moveBall(g *Game) bool {
 
 	b := &g.B
 	// update positions
-	b.V.Y -= BALL_GRAV_ACCEL / PHYS_FPS
-	b.O.X += b.V.X / PHYS_FPS
-	b.O.Y += b.V.Y / PHYS_FPS
+	b.V.Y -= BALL_GRAV_ACCEL / g.physFPS
+	b.O.X += b.V.X / g.physFPS
+	b.O.Y += b.V.Y / g.physFPS
 
 	// collide with players
 	moveBallCollide(b, g.P1)
@@ -209,7 +222,7 @@ func moveBall(g *Game) bool {
 	return hitGround
 }
 
-func movePlayer(p *Player, left bool) {
+func movePlayer(p *Player, left bool, fps float64) {
 	// simple horizontal movements
 	if p.L != p.R {
 		if p.L == left {
@@ -231,15 +244,15 @@ func movePlayer(p *Player, left bool) {
 	}
 
 	// Move X
-	p.O.X += p.V.X / PHYS_FPS
+	p.O.X += p.V.X / fps
 	if clamp(&p.O.X, L, R) {
 		p.V.X = 0
 	}
 
 	// Move Y
 	if p.O.Y != 0 || p.V.Y != 0 {
-		p.V.Y -= PL_GRAV_ACCEL / PHYS_FPS
-		p.O.Y += p.V.Y / PHYS_FPS
+		p.V.Y -= PL_GRAV_ACCEL / fps
+		p.O.Y += p.V.Y / fps
 		if p.O.Y <= 0 {
 			p.O.Y = 0
 			p.V.Y = 0 // stick to ground
@@ -249,11 +262,11 @@ func movePlayer(p *Player, left bool) {
 	}
 }
 
-// PhysicsFrame applies physics by moving all objects for a time increment of PHYS_TIME.
+// PhysicsFrame applies physics by moving all objects for the time of one frame.
 func (g *Game) PhysicsFrame(winner *int) {
 	// Move players first
-	movePlayer(g.P1, true)
-	movePlayer(g.P2, false)
+	movePlayer(g.P1, true, g.physFPS)
+	movePlayer(g.P2, false, g.physFPS)
 	// Move ball if necessary
 	if *winner == 0 {
 		if moveBall(g) {
@@ -267,14 +280,46 @@ func (g *Game) PhysicsFrame(winner *int) {
 	}
 }
 
+// updatePause tells the opponent when a player disconnects,
+// and brings the player up to date with the score when it resumes.
+func (g *Game) updatePause(was, detached bool, p, opponent *Player, s *score) {
+	if !was && detached {
+		opponent.SendPause(true)
+	}
+	if p.takeResumed() {
+		p.SendWelcome()
+		p.SendEnter(opponent.Name, opponent.Color)
+		isP1 := p == g.P1
+		if isP1 {
+			p.SendScore(s.p1Points, s.p2Points)
+		} else {
+			p.SendScore(s.p2Points, s.p1Points)
+		}
+		switch s.winner {
+		case 0:
+			p.SendNextRound(s.p1First == isP1)
+		case 1, 2:
+			p.SendEndRound((s.winner == 1) == isP1)
+		}
+		if was && !detached {
+			opponent.SendPause(false)
+		}
+	}
+}
+
 // Run is a loop that does not stop until a player quits.
 func (g *Game) Run() {
+	g.P1.setInMatch(true)
+	g.P2.setInMatch(true)
+	defer g.P1.setInMatch(false)
+	defer g.P2.setInMatch(false)
+
 	g.P1.SendEnter(g.P2.Name, g.P2.Color)
 	g.P2.SendEnter(g.P1.Name, g.P1.Color)
 
 	// extra game state
-	winner := 3
-	p1First := (rand.Intn(2) == 0)
+	s := score{winner: 3, p1First: rand.Intn(2) == 0}
+	defer func() { g.recordMatch(s.p1Points, s.p2Points) }()
 
 	// timers
 	gameStart := time.Now()
@@ -282,6 +327,8 @@ func (g *Game) Run() {
 	lastWorldState := gameStart
 	nextPing := gameStart
 	intermissionEnd := time.Time{}
+	p1Detached, p2Detached := false, false
+	pauseLeft := MAX_PAUSE
 
 GAME_LOOP:
 	for {
@@ -296,32 +343,51 @@ GAME_LOOP:
 
 		now := time.Now()
 
+		// Pause while a player is disconnected, until it resumes or runs out of time
+		p1Was, p2Was := p1Detached, p2Detached
+		p1Detached, p2Detached = g.P1.checkGrace(now, pauseLeft), g.P2.checkGrace(now, pauseLeft)
+		g.updatePause(p1Was, p1Detached, g.P1, g.P2, &s)
+		g.updatePause(p2Was, p2Detached, g.P2, g.P1, &s)
+		if p1Detached || p2Detached {
+			pauseLeft -= now.Sub(lastPhysics)
+			lastPhysics = now
+			lastWorldState = now
+			nextPing = now
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
 		// Apply physics
-		oldWinner := winner
+		oldWinner := s.winner
 		for now.After(lastPhysics) {
-			g.PhysicsFrame(&winner)
-			lastPhysics = lastPhysics.Add(PHYS_TIME)
+			g.PhysicsFrame(&s.winner)
+			lastPhysics = lastPhysics.Add(g.physTime)
 		}
 
 		// Update world state
 		for now.After(lastWorldState) {
 			g.P1.SendState(transformState(g.P1, g.P2, g.B.MoveState, true))
 			g.P2.SendState(transformState(g.P1, g.P2, g.B.MoveState, false))
-			lastWorldState = lastWorldState.Add(NETW_TIME)
+			lastWorldState = lastWorldState.Add(g.netTime)
 		}
 
 		// Update winner
-		if winner != 0 {
+		if s.winner != 0 {
 			if oldWinner == 0 {
-				g.P1.SendEndRound(winner == 1)
-				g.P2.SendEndRound(winner == 2)
+				if s.winner == 1 {
+					s.p1Points++
+				} else {
+					s.p2Points++
+				}
+				g.P1.SendEndRound(s.winner == 1)
+				g.P2.SendEndRound(s.winner == 2)
 				intermissionEnd = now.Add(750 * time.Millisecond)
 			} else if now.After(intermissionEnd) {
-				winner = 0
-				p1First = !p1First
-				g.P1.SendNextRound(p1First)
-				g.P2.SendNextRound(!p1First)
-				g.StartRound(p1First)
+				s.winner = 0
+				s.p1First = !s.p1First
+				g.P1.SendNextRound(s.p1First)
+				g.P2.SendNextRound(!s.p1First)
+				g.StartRound(s.p1First)
 			}
 		}
 
@@ -3,6 +3,7 @@ package slime
 import (
 	"bytes"
 	"sync"
+	"time"
 )
 
 // MoveState is the origin (position) and velocity of dynamic entities.
@@ -20,6 +21,7 @@ type Player struct {
 	// Inputs
 	Name  string
 	Color int
+	ID    string // account name, or blank for anonymous players
 	InputState
 
 	// Game State
@@ -31,16 +33,28 @@ type Player struct {
 
 	Ping int
 	RemotePlayer
+
+	// ResumeToken lets the player resume a match after disconnecting
+	ResumeToken   string
+	resumable     bool // sent a JSON hello, so knows about resume tokens
+	conn          *conn
+	inMatch       bool
+	detached      bool // disconnected, and waiting to resume
+	resumed       bool // resumed, and not yet brought up to date
+	detachedSince time.Time
+	connLock      sync.Mutex
 }
 
-// NewPlayer makes a player with the given name and color.
-func NewPlayer(name []byte, col int) *Player {
+// NewPlayer makes a player with the given name and color,
+// who may have sendBuffer outgoing messages queued.
+func NewPlayer(name []byte, col int, sendBuffer int) *Player {
 	p := new(Player)
 	p.Name = filterName(name)
 	p.Color = filterColor(col)
 	p.Ping = -1
 	p.Stop = make(chan struct{})
-	p.RemotePlayer = newRemotePlayer(p)
+	p.RemotePlayer = newRemotePlayer(p, sendBuffer)
+	p.ResumeToken = newResumeToken()
 	return p
 }
 
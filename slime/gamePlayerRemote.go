@@ -12,10 +12,10 @@ type RemotePlayer struct {
 }
 
 // newRemotePlayer makes a new RemotePlayer for a Player
-func newRemotePlayer(p *Player) RemotePlayer {
+func newRemotePlayer(p *Player, sendBuffer int) RemotePlayer {
 	return RemotePlayer{
 		p,
-		make(chan []byte, 70), // enough for at least 2 seconds
+		make(chan []byte, sendBuffer),
 	}
 }
 
@@ -61,6 +61,9 @@ func (r *RemotePlayer) SendWelcome() {
 	copy(b[4:], r.Name)
 
 	r.Send(b)
+	if r.resumable {
+		r.Send(append([]byte{10}, r.ResumeToken...))
+	}
 }
 
 func transformState(p1, p2 *Player, b MoveState, forP1 bool) (self, other, ball MoveState, selfKeys, otherKeys InputState) {
@@ -161,6 +164,25 @@ func (r *RemotePlayer) SendNextRound(isFirst bool) {
 	}
 }
 
+// SendScore tells the player the points of both players.
+func (r *RemotePlayer) SendScore(points, otherPoints int) {
+	b := make([]byte, 5)
+	b[0] = 12
+	binary.BigEndian.PutUint16(b[1:], uint16(points))
+	binary.BigEndian.PutUint16(b[3:], uint16(otherPoints))
+	r.Send(b)
+}
+
+// SendPause tells the player that the match is paused while the opponent
+// is disconnected, or that the opponent resumed.
+func (r *RemotePlayer) SendPause(paused bool) {
+	if paused {
+		r.Send([]byte{11, 1})
+	} else {
+		r.Send([]byte{11, 0})
+	}
+}
+
 func (r *RemotePlayer) SendPing() {
 	b := make([]byte, 9)
 	b[0] = 9
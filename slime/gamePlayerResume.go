@@ -0,0 +1,170 @@
+package slime
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Resume constants
+const (
+	// Time that a match waits for a disconnected player to resume
+	RESUME_GRACE = 15 * time.Second
+	// Total time that a match may be paused for disconnected players
+	MAX_PAUSE = 30 * time.Second
+	// Length of resume tokens, in bytes before hex encoding
+	RESUME_TOKEN_LEN = 16
+)
+
+// conn is a websocket connection of a Player.
+// A player that resumes gets a new conn.
+type conn struct {
+	ws   *websocket.Conn
+	done chan struct{} // closed when the connection is closed
+	once sync.Once
+}
+
+func newConn(ws *websocket.Conn) *conn {
+	return &conn{ws: ws, done: make(chan struct{})}
+}
+
+// close closes the connection. It is safe to call close multiple times.
+func (c *conn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.ws.Close()
+	})
+}
+
+// newResumeToken returns a random resume token.
+func newResumeToken() string {
+	b := make([]byte, RESUME_TOKEN_LEN)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// addResumable lets a player resume with its token until delResumable is called.
+func (s *Server) addResumable(p *Player) {
+	s.resumableLock.Lock()
+	defer s.resumableLock.Unlock()
+	s.resumable[p.ResumeToken] = p
+}
+
+// delResumable stops a player from resuming.
+func (s *Server) delResumable(p *Player) {
+	s.resumableLock.Lock()
+	defer s.resumableLock.Unlock()
+	delete(s.resumable, p.ResumeToken)
+}
+
+// attach gives a connection to a player.
+func (p *Player) attach(c *conn) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	p.conn = c
+}
+
+// resume gives a new connection to the disconnected player with a resume token.
+// It returns nil if there is no such player.
+func (s *Server) resume(token string, c *conn) *Player {
+	s.resumableLock.Lock()
+	p := s.resumable[token]
+	s.resumableLock.Unlock()
+	if p == nil {
+		return nil
+	}
+
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	if !p.detached || p.Stopped {
+		return nil
+	}
+	p.conn = c
+	p.detached = false
+	p.resumed = true
+
+	// Drop messages that the old connection did not send,
+	// since the player is brought up to date instead
+	for drained := false; !drained; {
+		select {
+		case <-p.SendBuf:
+		default:
+			drained = true
+		}
+	}
+	return p
+}
+
+// takeResumed checks if the player resumed since the last call.
+func (p *Player) takeResumed() bool {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	resumed := p.resumed
+	p.resumed = false
+	return resumed
+}
+
+// disconnect handles a closed connection. If the player is in a match,
+// and got a resume token, it is detached and may resume within RESUME_GRACE,
+// and otherwise it is closed.
+func (p *Player) disconnect(c *conn) {
+	c.close()
+
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	if p.conn != c {
+		// already replaced by a resumed connection
+		return
+	}
+	if p.inMatch && p.resumable && !p.Stopped {
+		p.detached = true
+		p.detachedSince = time.Now()
+	} else {
+		p.Close()
+	}
+}
+
+// isDetached checks if the player is disconnected, and waiting to resume.
+func (p *Player) isDetached() bool {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	return p.detached
+}
+
+// checkGrace closes a detached player that did not resume within RESUME_GRACE,
+// or before the match ran out of pause time, and returns whether the player
+// is still detached.
+func (p *Player) checkGrace(now time.Time, pauseLeft time.Duration) bool {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	if p.detached && (now.Sub(p.detachedSince) > RESUME_GRACE || pauseLeft <= 0) {
+		p.Close()
+	}
+	return p.detached
+}
+
+// setInMatch records whether the player is in a match. After a match,
+// a detached player cannot resume, so it is closed.
+func (p *Player) setInMatch(inMatch bool) {
+	p.connLock.Lock()
+	defer p.connLock.Unlock()
+	p.inMatch = inMatch
+	if !inMatch && p.detached {
+		p.Close()
+	}
+}
+
+// closeConn closes the current connection of the player.
+func (p *Player) closeConn() {
+	p.connLock.Lock()
+	c := p.conn
+	p.connLock.Unlock()
+	if c != nil {
+		c.close()
+	}
+}
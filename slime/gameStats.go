@@ -0,0 +1,40 @@
+package slime
+
+import (
+	"log"
+
+	"victorz.ca/gameserv/stats"
+)
+
+// recordStats merges statistics into those of a player.
+// Anonymous players are not recorded.
+func (g *Game) recordStats(p *Player, d stats.Stats) {
+	if g.store == nil || p.ID == "" {
+		return
+	}
+	if err := g.store.Add(p.ID, d); err != nil {
+		log.Printf("*stats for %v: %v\n", p.ID, err)
+	}
+}
+
+// recordMatch records the points of both players. A match lasts until
+// a player leaves, so the player who left loses, and the opponent wins,
+// unless both left. Nothing is recorded if no point was played.
+func (g *Game) recordMatch(p1Points, p2Points int) {
+	if p1Points == 0 && p2Points == 0 {
+		return
+	}
+	p1, p2 := g.P1, g.P2
+	p1Wins := p2.Stopped && !p1.Stopped
+	p2Wins := p1.Stopped && !p2.Stopped
+
+	d1 := stats.Stats{SlimePoints: uint(p1Points)}
+	d2 := stats.Stats{SlimePoints: uint(p2Points)}
+	if p1Wins {
+		d1.SlimeWins, d2.SlimeLosses = 1, 1
+	} else if p2Wins {
+		d2.SlimeWins, d1.SlimeLosses = 1, 1
+	}
+	g.recordStats(p1, d1)
+	g.recordStats(p2, d2)
+}
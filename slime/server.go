@@ -0,0 +1,99 @@
+package slime
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"victorz.ca/gameserv/auth"
+	"victorz.ca/gameserv/origin"
+	"victorz.ca/gameserv/stats"
+)
+
+// Server limits
+const (
+	// Maximum physics frames per second
+	MAX_PHYS_FPS = 1000
+	// Default number of messages queued for a player, enough for at least 2 seconds
+	SEND_BUFFER = 70
+)
+
+// Options configure a Server.
+type Options struct {
+	// Physics frames per second, from 1 to MAX_PHYS_FPS.
+	PhysFPS int
+	// World states sent per second, from 1 to PhysFPS.
+	NetFPS int
+	// Number of messages queued for a player before it is disconnected.
+	SendBuffer int
+
+	// Origins whose pages may connect.
+	// If it is nil, only pages from the same host may connect.
+	Origins *origin.Allowlist
+
+	// Where the statistics of players are recorded, or nil.
+	Store stats.Store
+	// Identifies players with tokens, or nil for every player to be anonymous.
+	Auth *auth.Auth
+}
+
+// Validate checks that the options are usable.
+func (opt Options) Validate() error {
+	if opt.PhysFPS < 1 || opt.PhysFPS > MAX_PHYS_FPS {
+		return fmt.Errorf("phys fps must be from 1 to %v", MAX_PHYS_FPS)
+	}
+	if opt.NetFPS < 1 || opt.NetFPS > opt.PhysFPS {
+		return fmt.Errorf("net fps must be from 1 to %v", opt.PhysFPS)
+	}
+	if opt.SendBuffer < 1 {
+		return fmt.Errorf("send buffer must be at least 1")
+	}
+	return nil
+}
+
+// DefaultOptions returns the options used by a server that is not configured.
+func DefaultOptions() Options {
+	return Options{
+		PhysFPS:    PHYS_FPS,
+		NetFPS:     NETW_FPS,
+		SendBuffer: SEND_BUFFER,
+	}
+}
+
+// A Server matches connected players in pairs, and runs their matches.
+type Server struct {
+	opt      Options
+	upgrader websocket.Upgrader
+	matcher  chan matchReq
+
+	pCount     int // current number of players
+	pCountLock sync.Mutex
+
+	resumable     map[string]*Player // players who may resume, by resume token
+	resumableLock sync.Mutex
+}
+
+// NewServer makes a Server with the given options, or fails if they are not usable.
+func NewServer(opt Options) (*Server, error) {
+	if err := opt.Validate(); err != nil {
+		return nil, err
+	}
+	return &Server{
+		opt:       opt,
+		upgrader:  origin.Upgrader(),
+		matcher:   make(chan matchReq),
+		resumable: make(map[string]*Player),
+	}, nil
+}
+
+// newGame creates a game for two players with the server's options.
+func (s *Server) newGame(p1, p2 *Player) Game {
+	g := NewGame(p1, p2)
+	g.physFPS = float64(s.opt.PhysFPS)
+	g.physTime = time.Second / time.Duration(s.opt.PhysFPS)
+	g.netTime = time.Second / time.Duration(s.opt.NetFPS)
+	g.store = s.opt.Store
+	return g
+}
@@ -2,31 +2,29 @@
 package slime
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var pCount = 0 // current number of players
-var pCountLock sync.Mutex
-
 // HandleNum writes the current number of players to the HTTP request.
-func HandleNum(w http.ResponseWriter, r *http.Request) {
-	n := pCount
+func (s *Server) HandleNum(w http.ResponseWriter, r *http.Request) {
+	n := s.pCount
 	fmt.Fprintf(w, "%v", n)
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
-
 // HandlePlayer serves a game client.
-func HandlePlayer(w http.ResponseWriter, r *http.Request) {
+func (s *Server) HandlePlayer(w http.ResponseWriter, r *http.Request) {
 	log.Printf(" [%v] connected\n", r.RemoteAddr)
-	c, err := upgrader.Upgrade(w, r, nil)
+	if !s.opt.Origins.Allow(r, false) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	c, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("*[%v] upgrade failed: %v\n", r.RemoteAddr, err)
 		return
@@ -34,44 +32,104 @@ func HandlePlayer(w http.ResponseWriter, r *http.Request) {
 	defer log.Printf(" [%v] disconnected\n", r.RemoteAddr)
 	defer c.Close()
 
-	p := processHello(c)
-	if p == nil {
+	h := processHello(c)
+	if h == nil {
+		return
+	}
+	pc := newConn(c)
+	if h.Resume != "" {
+		s.resumePlayer(r, pc, h.Resume)
 		return
 	}
 
-	pCountLock.Lock()
-	pCount++
-	pCountLock.Unlock()
-	log.Printf("+[%v] %v #%06x (%v now)\n", r.RemoteAddr, p.Name, p.Color, pCount)
+	p := NewPlayer([]byte(h.Name), h.Color, s.opt.SendBuffer)
+	p.Name, p.ID = s.opt.Auth.Identify(h.Token, p.Name)
+	p.resumable = h.text
+	p.attach(pc)
+	s.addResumable(p)
+
+	s.pCountLock.Lock()
+	s.pCount++
+	s.pCountLock.Unlock()
+	log.Printf("+[%v] %v #%06x (%v now)\n", r.RemoteAddr, p.Name, p.Color, s.pCount)
+
+	go reader(p, pc)
+	go writer(p, pc)
+	s.playMatches(p.Player)
+	s.delResumable(p)
+	p.closeConn()
+
+	s.pCountLock.Lock()
+	s.pCount--
+	s.pCountLock.Unlock()
+	log.Printf("-[%v] %v (%v total)\n", r.RemoteAddr, p.Name, s.pCount)
+}
 
-	go reader(p, c)
-	go writer(p, c)
-	playMatches(p.Player)
+// hello is the JSON form of the hello message, which may include a token,
+// or a resume token to continue a match after a disconnection.
+type hello struct {
+	Name   string `json:"name"`
+	Color  int    `json:"color"`
+	Token  string `json:"token"`
+	Resume string `json:"resume"`
 
-	pCountLock.Lock()
-	pCount--
-	pCountLock.Unlock()
-	log.Printf("-[%v] %v (%v total)\n", r.RemoteAddr, p.Name, pCount)
+	text bool // sent as a JSON text message
 }
 
-func processHello(c *websocket.Conn) *Player {
-	mt, h, err := c.ReadMessage()
+// processHello processes the first incoming message, which is either binary,
+// with a 24-bit color followed by the name, or a JSON text message, for example:
+//
+//	{"name": "Blob", "color": 16744448, "token": "..."}
+//	{"resume": "..."}
+func processHello(c *websocket.Conn) *hello {
+	mt, msg, err := c.ReadMessage()
+	if err != nil {
+		return nil
+	}
 
-	if mt != websocket.BinaryMessage || err != nil || len(h) < 3 {
+	var h hello
+	switch {
+	case mt == websocket.BinaryMessage && len(msg) >= 3:
+		h.Name = string(msg[3:])
+		h.Color = int(msg[0])<<16 | int(msg[1])<<8 | int(msg[2])
+	case mt == websocket.TextMessage:
+		if err := json.Unmarshal(msg, &h); err != nil {
+			return nil
+		}
+		h.text = true
+	default:
 		return nil
 	}
 
-	name := h[3:]
-	col := int(h[0])<<16 | int(h[1])<<8 | int(h[2])
+	return &h
+}
 
-	return NewPlayer(name, col)
+// resumePlayer serves a client that resumes a match with a resume token,
+// until the player leaves or disconnects again.
+func (s *Server) resumePlayer(r *http.Request, c *conn, token string) {
+	p := s.resume(token, c)
+	if p == nil {
+		log.Printf("*[%v] cannot resume\n", r.RemoteAddr)
+		msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "cannot resume")
+		c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		return
+	}
+	log.Printf("+[%v] %v resumed\n", r.RemoteAddr, p.Name)
+
+	go reader(p, c)
+	go writer(p, c)
+	select {
+	case <-p.Stop:
+	case <-c.done:
+	}
+	log.Printf("-[%v] %v left resumed match\n", r.RemoteAddr, p.Name)
 }
 
-func reader(p *Player, c *websocket.Conn) {
-	defer p.Close()
+func reader(p *Player, c *conn) {
+	defer p.disconnect(c)
 
 	for {
-		_, msg, err := c.ReadMessage()
+		_, msg, err := c.ws.ReadMessage()
 		if err != nil {
 			break
 		}
@@ -79,13 +137,18 @@ func reader(p *Player, c *websocket.Conn) {
 	}
 }
 
-func writer(p *Player, c *websocket.Conn) {
-	defer p.Close()
+func writer(p *Player, c *conn) {
+	defer p.disconnect(c)
 
-	for msg := range p.SendBuf {
-		mt := websocket.BinaryMessage
-		if err := c.WriteMessage(mt, msg); err != nil {
-			break
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-p.SendBuf:
+			mt := websocket.BinaryMessage
+			if err := c.ws.WriteMessage(mt, msg); err != nil {
+				return
+			}
 		}
 	}
 }
@@ -95,21 +158,19 @@ type matchReq struct {
 	result chan struct{}
 }
 
-var matcher = make(chan matchReq)
-
-func playMatches(p *Player) {
+func (s *Server) playMatches(p *Player) {
 	p.SendWelcome()
 	for {
 		m := matchReq{p, make(chan struct{})}
 		select {
 		case <-p.Stop:
 			return
-		case matcher <- m:
+		case s.matcher <- m:
 			// wait for game to end
 			<-m.result
-		case other := <-matcher:
+		case other := <-s.matcher:
 			m.result = nil // free unused chan
-			g := NewGame(p, other.p)
+			g := s.newGame(p, other.p)
 			g.Run()
 			other.result <- struct{}{}
 		}
@@ -0,0 +1,143 @@
+package stats
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Interval of saves of a FileStore with pending changes
+const FILE_SAVE_TIME = 30 * time.Second
+
+// FileStore is a Store kept in memory, and saved to a JSON file periodically.
+type FileStore struct {
+	path  string
+	stats map[string]Stats
+	dirty bool
+	lock  sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewFileStore loads a FileStore from a JSON file,
+// which is created when it is first saved if it does not exist.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:  path,
+		stats: make(map[string]Stats),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(b, &s.stats); err != nil {
+			return nil, err
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// Add merges d into the statistics of an identity.
+func (s *FileStore) Add(id string, d Stats) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st := s.stats[id]
+	st.Merge(d)
+	s.stats[id] = st
+	s.dirty = true
+	return nil
+}
+
+// Get returns the statistics of an identity, and false if there are none.
+func (s *FileStore) Get(id string) (Stats, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	st, ok := s.stats[id]
+	return st, ok, nil
+}
+
+// All returns a copy of the statistics of every identity.
+func (s *FileStore) All() (map[string]Stats, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	all := make(map[string]Stats, len(s.stats))
+	for id, st := range s.stats {
+		all[id] = st
+	}
+	return all, nil
+}
+
+// Close saves any pending changes, and stops periodic saves.
+func (s *FileStore) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.save()
+}
+
+// run saves pending changes periodically, until Close is called.
+func (s *FileStore) run() {
+	defer close(s.done)
+	tick := time.NewTicker(FILE_SAVE_TIME)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-tick.C:
+			if err := s.save(); err != nil {
+				log.Printf("*stats %v: %v\n", s.path, err)
+			}
+		}
+	}
+}
+
+// save writes the statistics to the file if they changed.
+// On failure, they are saved again next time.
+func (s *FileStore) save() error {
+	s.lock.Lock()
+	if !s.dirty {
+		s.lock.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.stats)
+	s.dirty = false
+	s.lock.Unlock()
+
+	if err == nil {
+		err = s.write(b)
+	}
+	if err != nil {
+		s.lock.Lock()
+		s.dirty = true
+		s.lock.Unlock()
+	}
+	return err
+}
+
+// write writes to a temporary file, and replaces the file with it.
+func (s *FileStore) write(b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,125 @@
+// Package stats records statistics of players across games and sessions.
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Stats are the statistics of one identity.
+type Stats struct {
+	SlimeWins   uint `json:"slime_wins"`
+	SlimeLosses uint `json:"slime_losses"`
+	SlimePoints uint `json:"slime_points"`
+
+	DuelKills     uint `json:"duel_kills"`
+	DuelDeaths    uint `json:"duel_deaths"`
+	DuelBestCombo uint `json:"duel_best_combo"`
+	DuelPeakMass  uint `json:"duel_peak_mass"`
+}
+
+// Merge adds the counts of d to s, and keeps the best of the records.
+func (s *Stats) Merge(d Stats) {
+	s.SlimeWins += d.SlimeWins
+	s.SlimeLosses += d.SlimeLosses
+	s.SlimePoints += d.SlimePoints
+	s.DuelKills += d.DuelKills
+	s.DuelDeaths += d.DuelDeaths
+	if d.DuelBestCombo > s.DuelBestCombo {
+		s.DuelBestCombo = d.DuelBestCombo
+	}
+	if d.DuelPeakMass > s.DuelPeakMass {
+		s.DuelPeakMass = d.DuelPeakMass
+	}
+}
+
+// A Store keeps the statistics of every identity.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Add merges d into the statistics of an identity.
+	Add(id string, d Stats) error
+	// Get returns the statistics of an identity, and false if there are none.
+	Get(id string) (Stats, bool, error)
+	// All returns the statistics of every identity.
+	All() (map[string]Stats, error)
+	// Close saves any pending changes and releases the store.
+	Close() error
+}
+
+// Standing is the statistics of one identity, in a list of standings.
+type Standing struct {
+	ID string `json:"id"`
+	Stats
+}
+
+// sortKeys are the statistics that standings can be sorted by.
+var sortKeys = map[string]func(*Stats) uint{
+	"slime_wins":      func(s *Stats) uint { return s.SlimeWins },
+	"slime_losses":    func(s *Stats) uint { return s.SlimeLosses },
+	"slime_points":    func(s *Stats) uint { return s.SlimePoints },
+	"duel_kills":      func(s *Stats) uint { return s.DuelKills },
+	"duel_deaths":     func(s *Stats) uint { return s.DuelDeaths },
+	"duel_best_combo": func(s *Stats) uint { return s.DuelBestCombo },
+	"duel_peak_mass":  func(s *Stats) uint { return s.DuelPeakMass },
+}
+
+// Handler returns an HTTP handler that responds with statistics as JSON.
+// With the "id" query parameter, it responds with the statistics of that identity.
+// Otherwise, it responds with a list of standings, sorted in decreasing order
+// by the "by" query parameter (slime_wins by default), and limited to
+// the number in the "n" query parameter.
+func Handler(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if id := q.Get("id"); id != "" {
+			s, ok, err := store.Get(id)
+			if err != nil {
+				http.Error(w, "cannot read stats", http.StatusInternalServerError)
+				return
+			} else if !ok {
+				http.Error(w, "no such player", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, Standing{id, s})
+			return
+		}
+
+		by := "slime_wins"
+		if b := q.Get("by"); b != "" {
+			by = b
+		}
+		key, ok := sortKeys[by]
+		if !ok {
+			http.Error(w, "bad sort key", http.StatusBadRequest)
+			return
+		}
+
+		all, err := store.All()
+		if err != nil {
+			http.Error(w, "cannot read stats", http.StatusInternalServerError)
+			return
+		}
+		standings := make([]Standing, 0, len(all))
+		for id, s := range all {
+			standings = append(standings, Standing{id, s})
+		}
+		sort.Slice(standings, func(i, j int) bool {
+			a, b := key(&standings[i].Stats), key(&standings[j].Stats)
+			if a != b {
+				return a > b
+			}
+			return standings[i].ID < standings[j].ID
+		})
+		if n, err := strconv.Atoi(q.Get("n")); err == nil && n >= 0 && n < len(standings) {
+			standings = standings[:n]
+		}
+		writeJSON(w, standings)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
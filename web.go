@@ -1,46 +1,179 @@
 package main
 
 import (
+	"victorz.ca/gameserv/auth"
 	"victorz.ca/gameserv/duel"
+	"victorz.ca/gameserv/origin"
 	"victorz.ca/gameserv/slime"
+	"victorz.ca/gameserv/stats"
 
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-var duelGame = duel.NewGame()
-
-func init() {
-	http.HandleFunc("/s/n", slime.HandleNum)
-	http.HandleFunc("/s", slime.HandlePlayer)
-	http.HandleFunc("/d/n", duelGame.HandleNum)
-	http.HandleFunc("/d", duelGame.HandlePlayer)
-	http.HandleFunc("/", hello)
-}
+// Time to wait for HTTP requests to finish when shutting down
+const SHUTDOWN_TIME = 5 * time.Second
 
 func hello(res http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(res, "hello")
 }
 
+// shutdown stops accepting connections, then stops the duel arenas,
+// which finishes their replays and records their stats,
+// and finally saves the stats.
+func shutdown(srv *http.Server, duelArenas *duel.Manager, store stats.Store) {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIME)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Printf("Cannot stop HTTP server: %v\n", err)
+	}
+
+	duelArenas.Close()
+	if store != nil {
+		if err := store.Close(); err != nil {
+			fmt.Printf("Cannot save stats: %v\n", err)
+		}
+	}
+}
+
 // Entry point of server program
 func main() {
 	// OLD background tasks
 	// slime_done := slime.LaunchCron()
 	// defer close(slime_done)
 
-	go duelGame.Run()
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Printf("Invalid configuration: %v\n", err)
+		os.Exit(2)
+	}
+
+	origins, err := origin.New(cfg.Origins)
+	if err != nil {
+		panic(err)
+	}
+	origins.AdminKey = cfg.OriginsKey
+
+	slimeOpt := cfg.slimeOptions()
+	slimeOpt.Origins = origins
+
+	var store stats.Store
+	if cfg.StatsFile != "" {
+		s, err := stats.NewFileStore(cfg.StatsFile)
+		if err != nil {
+			panic(err)
+		}
+		store = s
+		slimeOpt.Store = store
+	}
+
+	var accounts *auth.Auth
+	if cfg.AuthFile != "" {
+		a, err := auth.New(cfg.AuthFile, cfg.AuthKey)
+		if err != nil {
+			panic(err)
+		}
+		accounts = a
+		slimeOpt.Auth = accounts
+	}
+
+	slimeServer, err := slime.NewServer(slimeOpt)
+	if err != nil {
+		panic(err)
+	}
+
+	if cfg.Duel.BotNames != "" {
+		if err := duel.LoadBotNames(cfg.Duel.BotNames); err != nil {
+			panic(err)
+		}
+	}
+
+	if cfg.Duel.Skins != "" {
+		if err := duel.LoadSkins(cfg.Duel.Skins); err != nil {
+			panic(err)
+		}
+	}
+
+	duelOpt := cfg.duelOptions()
+	if cfg.Duel.Maps != "" {
+		maps, err := duel.LoadMaps(cfg.Duel.Maps)
+		if err != nil {
+			panic(err)
+		}
+		duelOpt.Maps = maps
+	}
+
+	duelOpt.ReplayDir = cfg.Duel.Replays
+	duelOpt.Store = store
+	duelOpt.Auth = accounts
+
+	duelArenas := duel.NewManager(duelOpt)
+	duelArenas.AdminKey = cfg.Duel.AdminKey
+	duelArenas.ReplayDir = duelOpt.ReplayDir
+	duelArenas.Auth = accounts
+	duelArenas.Origins = origins
+	for name, a := range cfg.Duel.Arenas {
+		opt, err := a.options(duelOpt)
+		if err == nil {
+			err = duelArenas.Open(name, opt)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	go duelArenas.Run()
+
+	routes := cfg.Routes
+	http.HandleFunc(routes.Slime+"/n", slimeServer.HandleNum)
+	http.HandleFunc(routes.Slime, slimeServer.HandlePlayer)
+	http.HandleFunc(routes.Duel+"/n", duelArenas.HandleNum)
+	http.HandleFunc(routes.Duel+"/bots", duelArenas.HandleBots)
+	http.HandleFunc(routes.Duel+"/stats", duelArenas.HandleStats)
+	http.HandleFunc(routes.Duel+"/replay", duelArenas.HandleReplay)
+	http.HandleFunc(routes.Duel, duelArenas.HandlePlayer)
+	if store != nil {
+		http.HandleFunc(routes.Stats, stats.Handler(store))
+	}
+	if accounts != nil {
+		http.HandleFunc(routes.Login, accounts.HandleLogin)
+		http.HandleFunc(routes.Register, accounts.HandleRegister)
+	}
+	http.HandleFunc(routes.Origins, origins.HandleStats)
+	http.HandleFunc("/", hello)
 
 	bind := ":8080"
-	if env := os.Getenv("OPENSHIFT_GO_PORT"); env != "" {
+	if cfg.Addr != "" {
+		bind = cfg.Addr
+	} else if env := os.Getenv("OPENSHIFT_GO_PORT"); env != "" {
 		bind = os.Getenv("OPENSHIFT_GO_IP") + ":" + env
 	} else if env := os.Getenv("PORT"); env != "" {
 		bind = ":" + env
 	}
 
+	srv := &http.Server{Addr: bind}
+
+	// Finish replays and save stats before exiting
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-sig
+		shutdown(srv, duelArenas, store)
+		close(stopped)
+	}()
+
 	fmt.Printf("Listening on %s\n", bind)
-	err := http.ListenAndServe(bind, nil)
-	if err != nil {
+	err = srv.ListenAndServe()
+	if err != http.ErrServerClosed {
 		panic(err)
 	}
+	<-stopped
 }